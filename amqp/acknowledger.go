@@ -0,0 +1,129 @@
+package amqp
+
+import (
+	"sync"
+	"time"
+
+	amqp_driver "github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// trackingAcknowledger counts the handler outcome of the delivery
+// and the time from the handler got it to the ack
+type trackingAcknowledger struct {
+	amqp_driver.Acknowledger
+	m      ConsumerMetrics
+	stats  *handlerStats
+	mu     sync.Mutex
+	begin  time.Time
+	done   bool
+	onAck  func()                          // marks the dedup key
+	onDone func(outcome string, err error) // archives the outcome to the tap
+	span   trace.Span                      // consumer span, ends on the outcome
+}
+
+func newTrackingAcknowledger(a amqp_driver.Acknowledger, m ConsumerMetrics, stats *handlerStats) *trackingAcknowledger {
+	m.InFlight.Inc()
+	return &trackingAcknowledger{
+		Acknowledger: a,
+		m:            m,
+		stats:        stats,
+		begin:        time.Now(),
+	}
+}
+
+// start is called when the handler took the delivery
+func (t *trackingAcknowledger) start() {
+	t.mu.Lock()
+	if !t.done {
+		t.begin = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+func (t *trackingAcknowledger) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	took := time.Since(t.begin)
+	t.m.InFlight.Dec()
+	t.m.HandlerDuration.Observe(took.Seconds())
+	if t.stats != nil {
+		t.stats.observe(took)
+	}
+}
+
+// release ends the delivery no handler took, nothing is observed,
+// rabbit requeues it when its channel is closed
+func (t *trackingAcknowledger) release() {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = true
+	t.mu.Unlock()
+	t.m.InFlight.Dec()
+	if t.span != nil {
+		t.span.SetStatus(codes.Error, "not handled")
+	}
+	t.archive(TapOutcomeNotHandled, nil)
+}
+
+func (t *trackingAcknowledger) Ack(tag uint64, multiple bool) error {
+	t.finish()
+	t.m.Acked.Inc()
+	// the handler has done its work, so the key is marked even if the broker ack fails
+	// and the redelivery after the closed channel is dropped as a duplicate
+	if t.onAck != nil {
+		t.onAck()
+	}
+	err := t.Acknowledger.Ack(tag, multiple)
+	t.archive(TapOutcomeAcked, err)
+	return err
+}
+
+func (t *trackingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	t.finish()
+	t.m.Nacked.Inc()
+	outcome := TapOutcomeNacked
+	if requeue {
+		t.m.Requeued.Inc()
+		outcome = TapOutcomeRequeued
+	}
+	err := t.Acknowledger.Nack(tag, multiple, requeue)
+	t.archive(outcome, err)
+	return err
+}
+
+func (t *trackingAcknowledger) Reject(tag uint64, requeue bool) error {
+	t.finish()
+	t.m.Rejected.Inc()
+	outcome := TapOutcomeRejected
+	if requeue {
+		t.m.Requeued.Inc()
+		outcome = TapOutcomeRequeued
+	}
+	err := t.Acknowledger.Reject(tag, requeue)
+	t.archive(outcome, err)
+	return err
+}
+
+func (t *trackingAcknowledger) archive(outcome string, err error) {
+	if t.onDone != nil {
+		t.onDone(outcome, err)
+	}
+	if t.span != nil {
+		t.span.SetAttributes(attribute.String("rbmq.outcome", outcome))
+		if err != nil {
+			t.span.RecordError(err)
+			t.span.SetStatus(codes.Error, err.Error())
+		}
+		t.span.End()
+	}
+}
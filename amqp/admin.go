@@ -0,0 +1,333 @@
+package amqp
+
+// queue administration for the admin tool: inspect, peek, move, purge, dump and restore.
+// every operation opens own channel, the messages taken and not acked
+// are returned to the queue when the channel is closed
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+type Admin struct {
+	conn     *Connection
+	topology *config.Topology // declare options of the missing queues
+}
+
+func NewAdmin(conn *Connection) *Admin {
+	return &Admin{conn: conn}
+}
+
+// SetTopology sets the options the missing queues are declared with by move and restore,
+// nothing is declared until a queue is needed
+func (a *Admin) SetTopology(t config.Topology) {
+	a.topology = &t
+}
+
+// DumpedMessage is the json line of the queue dump,
+// the body is kept as text when it is utf8 and as base64 otherwise
+type DumpedMessage struct {
+	Queue         string                 `json:"queue,omitempty"`
+	DumpedAt      time.Time              `json:"dumped_at"`
+	ContentType   string                 `json:"content_type,omitempty"`
+	Headers       map[string]interface{} `json:"headers,omitempty"`
+	DeliveryMode  uint8                  `json:"delivery_mode,omitempty"` // 2 is persistent
+	Priority      uint8                  `json:"priority,omitempty"`
+	CorrelationId string                 `json:"correlation_id,omitempty"`
+	ReplyTo       string                 `json:"reply_to,omitempty"`
+	Expiration    string                 `json:"expiration,omitempty"`
+	MessageId     string                 `json:"message_id,omitempty"`
+	Timestamp     *time.Time             `json:"timestamp,omitempty"`
+	Type          string                 `json:"type,omitempty"`
+	UserId        string                 `json:"user_id,omitempty"`
+	AppId         string                 `json:"app_id,omitempty"`
+	Body          string                 `json:"body,omitempty"`
+	BodyBase64    []byte                 `json:"body_base64,omitempty"`
+}
+
+func dumpedMessage(queue string, d amqp_driver.Delivery) DumpedMessage {
+	m := DumpedMessage{
+		Queue:         queue,
+		DumpedAt:      time.Now().UTC(),
+		ContentType:   d.ContentType,
+		Headers:       d.Headers,
+		DeliveryMode:  d.DeliveryMode,
+		Priority:      d.Priority,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Expiration:    d.Expiration,
+		MessageId:     d.MessageId,
+		Type:          d.Type,
+		UserId:        d.UserId,
+		AppId:         d.AppId,
+	}
+	if !d.Timestamp.IsZero() {
+		m.Timestamp = &d.Timestamp
+	}
+	if utf8.Valid(d.Body) {
+		m.Body = string(d.Body)
+	} else {
+		m.BodyBase64 = d.Body
+	}
+	return m
+}
+
+func (m DumpedMessage) Bytes() []byte {
+	if m.BodyBase64 != nil {
+		return m.BodyBase64
+	}
+	return []byte(m.Body)
+}
+
+// Publishing restores the message properties
+func (m DumpedMessage) Publishing() amqp_driver.Publishing {
+	p := amqp_driver.Publishing{
+		ContentType:   m.ContentType,
+		Headers:       amqp_driver.Table(m.Headers),
+		DeliveryMode:  m.DeliveryMode,
+		Priority:      m.Priority,
+		CorrelationId: m.CorrelationId,
+		ReplyTo:       m.ReplyTo,
+		Expiration:    m.Expiration,
+		MessageId:     m.MessageId,
+		Type:          m.Type,
+		UserId:        m.UserId,
+		AppId:         m.AppId,
+		Body:          m.Bytes(),
+	}
+	if m.Timestamp != nil {
+		p.Timestamp = *m.Timestamp
+	}
+	return p
+}
+
+// ReadDump calls fn for every message of the json lines dump till fn returns false
+func ReadDump(r io.Reader, fn func(line int, m DumpedMessage) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var m DumpedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return fmt.Errorf("line %d: json.Unmarshal: %s", line, err.Error())
+		}
+		if !fn(line, m) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner.Scan: %s", err.Error())
+	}
+	return nil
+}
+
+// Inspect returns the depth and consumers of the queue
+func (a *Admin) Inspect(queue string) (amqp_driver.Queue, error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return amqp_driver.Queue{}, err
+	}
+	defer ch.Close()
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return q, fmt.Errorf("%s Channel.QueueInspect: %s", queue, err.Error())
+	}
+	return q, nil
+}
+
+// Peek returns up to n messages from the head of the queue, they stay in the queue
+func (a *Admin) Peek(queue string, n int) ([]amqp_driver.Delivery, error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// closing the channel requeues the messages
+	defer ch.Close()
+
+	var msgs []amqp_driver.Delivery
+	for len(msgs) < n {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return msgs, fmt.Errorf("%s Channel.Get: %s", queue, err.Error())
+		}
+		if !ok {
+			break
+		}
+		msgs = append(msgs, d)
+	}
+	return msgs, nil
+}
+
+// ensureQueue declares the queue missing in rabbit with the options of the admin topology,
+// the existing queue is used as is, so its declare options do not matter
+func (a *Admin) ensureQueue(ch Channel, name string) error {
+	if a.conn.isDeclared(name) {
+		return nil
+	}
+	if _, err := a.Inspect(name); err == nil {
+		a.conn.markDeclared(name)
+		return nil
+	}
+	topology := a.topology
+	if topology == nil {
+		topology = a.conn.Topology()
+	}
+	if _, err := queueDeclare(ch, name, topology); err != nil {
+		return err
+	}
+	a.conn.markDeclared(name)
+	return nil
+}
+
+// confirmChannel opens the channel in confirm mode
+func (a *Admin) confirmChannel() (Channel, chan amqp_driver.Confirmation, error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("Channel.Confirm: %s", err.Error())
+	}
+	return ch, ch.NotifyPublish(make(chan amqp_driver.Confirmation, 1)), nil
+}
+
+// publishConfirmed publishes the message and waits for rabbit to confirm it
+func publishConfirmed(ch Channel, confirms chan amqp_driver.Confirmation, queue string, p amqp_driver.Publishing) error {
+	if err := ch.Publish("", queue, false, false, p); err != nil {
+		return fmt.Errorf("%s Channel.Publish: %s", queue, err.Error())
+	}
+	confirm, ok := <-confirms
+	if !ok {
+		return fmt.Errorf("%s: channel closed before the publish confirm", queue)
+	}
+	if !confirm.Ack {
+		return fmt.Errorf("%s: publish is not confirmed", queue)
+	}
+	return nil
+}
+
+// Move publishes up to n messages to the target queue and removes them from the source,
+// n <= 0 moves all messages.
+// the source message is acked only when rabbit confirmed the publish
+func (a *Admin) Move(from, to string, n int) (moved int, err error) {
+	if from == to {
+		return 0, fmt.Errorf("%s: move to the same queue", from)
+	}
+	ch, confirms, err := a.confirmChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	if err = a.ensureQueue(ch, to); err != nil {
+		return 0, fmt.Errorf("%s Channel.QueueDeclare: %s", to, err.Error())
+	}
+
+	for n <= 0 || moved < n {
+		d, ok, err := ch.Get(from, false)
+		if err != nil {
+			return moved, fmt.Errorf("%s Channel.Get: %s", from, err.Error())
+		}
+		if !ok {
+			break
+		}
+		// the unacked source message is requeued when the channel is closed
+		if err = publishConfirmed(ch, confirms, to, dumpedMessage(from, d).Publishing()); err != nil {
+			return moved, err
+		}
+		if err = d.Ack(false); err != nil {
+			return moved, fmt.Errorf("%s Ack: %s", from, err.Error())
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// Purge removes the ready messages of the queue
+func (a *Admin) Purge(queue string) (int, error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	purged, err := ch.QueuePurge(queue, false)
+	if err != nil {
+		return 0, fmt.Errorf("%s Channel.QueuePurge: %s", queue, err.Error())
+	}
+	return purged, nil
+}
+
+// Dump writes all messages of the queue as json lines,
+// the messages are removed from the queue only if remove is set
+func (a *Admin) Dump(queue string, w io.Writer, remove bool) (dumped int, err error) {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	enc := json.NewEncoder(w)
+	for {
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return dumped, fmt.Errorf("%s Channel.Get: %s", queue, err.Error())
+		}
+		if !ok {
+			return dumped, nil
+		}
+		if err = enc.Encode(dumpedMessage(queue, d)); err != nil {
+			return dumped, fmt.Errorf("json.Encode: %s", err.Error())
+		}
+		if remove {
+			if err = d.Ack(false); err != nil {
+				return dumped, fmt.Errorf("%s Ack: %s", queue, err.Error())
+			}
+		}
+		dumped++
+	}
+}
+
+// Restore publishes the messages of the json lines dump to the queue,
+// empty queue restores every message to its dumped queue.
+// the message is counted as restored when rabbit confirmed the publish
+func (a *Admin) Restore(queue string, r io.Reader) (restored int, err error) {
+	ch, confirms, err := a.confirmChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	var publishErr error
+	err = ReadDump(r, func(line int, m DumpedMessage) bool {
+		to := queue
+		if to == "" {
+			to = m.Queue
+		}
+		if publishErr = a.ensureQueue(ch, to); publishErr != nil {
+			publishErr = fmt.Errorf("line %d: %s Channel.QueueDeclare: %s", line, to, publishErr.Error())
+			return false
+		}
+		if publishErr = publishConfirmed(ch, confirms, to, m.Publishing()); publishErr != nil {
+			publishErr = fmt.Errorf("line %d: %s", line, publishErr.Error())
+			return false
+		}
+		restored++
+		return true
+	})
+	if err != nil {
+		return restored, err
+	}
+	return restored, publishErr
+}
@@ -0,0 +1,129 @@
+package amqptest_test
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/amqp"
+	"github.com/linkit360/go-utils/amqp/amqptest"
+)
+
+func adminPublishing(body string) amqp_driver.Publishing {
+	return amqp_driver.Publishing{
+		Headers:       amqp_driver.Table{"x-retry": int32(2)},
+		ContentType:   amqp.ContentTypeJSON,
+		DeliveryMode:  amqp_driver.Persistent,
+		Priority:      5,
+		CorrelationId: "c-" + body,
+		ReplyTo:       "replies",
+		Expiration:    "60000",
+		MessageId:     "m-" + body,
+		Timestamp:     time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+		Type:          "charge",
+		UserId:        "linkit",
+		AppId:         "mt_manager",
+		Body:          []byte(body),
+	}
+}
+
+// the moved and restored messages keep every property of the original,
+// the json dump keeps the header values but not their types
+func samePublishing(t *testing.T, got, want amqp_driver.Publishing) {
+	t.Helper()
+	got.Timestamp = got.Timestamp.UTC()
+	if fmt.Sprint(got.Headers) != fmt.Sprint(want.Headers) {
+		t.Fatalf("headers %v, want %v", got.Headers, want.Headers)
+	}
+	got.Headers, want.Headers = nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestAdminMoveRestore(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	admin := amqp.NewAdmin(conn)
+
+	bodies := []string{"1", "2", "3"}
+	for _, body := range bodies {
+		b.Inject("src", adminPublishing(body))
+	}
+
+	tests := []struct {
+		name  string
+		n     int
+		moved int
+		left  int
+	}{
+		{"two", 2, 2, 1},
+		{"the rest", 0, 1, 0},
+		{"empty source", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		moved, err := admin.Move("src", "dst", tt.n)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err.Error())
+		}
+		if moved != tt.moved {
+			t.Fatalf("%s: moved %d, want %d", tt.name, moved, tt.moved)
+		}
+		if q, _ := b.Queue("src"); q.Messages != tt.left {
+			t.Fatalf("%s: %d messages left in the source, want %d", tt.name, q.Messages, tt.left)
+		}
+	}
+	if _, err := admin.Move("dst", "dst", 0); err == nil {
+		t.Fatal("moved to the same queue")
+	}
+	moved := b.Messages("dst")
+	if len(moved) != len(bodies) {
+		t.Fatalf("%d messages in the target, want %d", len(moved), len(bodies))
+	}
+	for i, p := range moved {
+		samePublishing(t, p, adminPublishing(bodies[i]))
+	}
+
+	var dump bytes.Buffer
+	dumped, err := admin.Dump("dst", &dump, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := b.Queue("dst"); dumped != len(bodies) || q.Messages != 0 {
+		t.Fatalf("dumped %d, left %d", dumped, q.Messages)
+	}
+	restored, err := admin.Restore("restored", &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != len(bodies) {
+		t.Fatalf("restored %d, want %d", restored, len(bodies))
+	}
+	for i, p := range b.Messages("restored") {
+		samePublishing(t, p, adminPublishing(bodies[i]))
+	}
+}
+
+// the publish refused by rabbit is not counted and the source message stays
+func TestAdminMoveRefused(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	admin := amqp.NewAdmin(conn)
+
+	b.Inject("src", adminPublishing("1"))
+	b.RefusePublish(amqp_driver.ErrClosed)
+	moved, err := admin.Move("src", "dst", 0)
+	if err == nil || moved != 0 {
+		t.Fatalf("moved %d, error %v", moved, err)
+	}
+	eventually(t, "source message requeued", func() bool {
+		q, _ := b.Queue("src")
+		return q.Messages == 1
+	})
+}
@@ -0,0 +1,361 @@
+package amqptest
+
+// in-memory broker implementing the subset of amqp 0-9-1 the amqp package uses:
+// queue and exchange declare, bind, publish, consume, ack, nack, reject, qos and inspect.
+// channel errors close the channel like rabbit does.
+// faults are injected by the broker methods, so reconnects are tested without rabbit:
+//
+//	b := amqptest.NewBroker()
+//	conn := amqp.NewConnectionWithDialer(amqp.ConnectionConfig{URI: "amqp://test"}, 0, b.Dial)
+//	<-conn.Ready()
+//	b.DropConnections()
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/amqp"
+)
+
+// ErrRefused may be passed to RefuseDial and RefusePublish
+var ErrRefused = errors.New("amqptest: refused")
+
+type Broker struct {
+	mu         sync.Mutex
+	queues     map[string]*queue
+	exchanges  map[string]*exchange
+	conns      map[*Conn]bool
+	dials      int
+	published  int
+	seq        uint64
+	dialErr    error
+	publishErr error
+	// accept x-delayed-message exchanges, set before dialing
+	DelayedMessagePlugin bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		queues:    make(map[string]*queue),
+		exchanges: make(map[string]*exchange),
+		conns:     make(map[*Conn]bool),
+	}
+}
+
+type message struct {
+	id          uint64
+	p           amqp_driver.Publishing
+	exchange    string
+	key         string
+	redelivered bool
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp_driver.Table
+	ready      []message
+	consumers  []*consumer
+	next       int // round robin
+}
+
+type binding struct {
+	key   string
+	queue string
+}
+
+type exchange struct {
+	name     string
+	kind     string
+	bindings []binding
+}
+
+// Dial is the amqp.Dialer of the broker
+func (b *Broker) Dial(url string, conf amqp_driver.Config) (amqp.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.dialErr != nil {
+		return nil, b.dialErr
+	}
+	c := &Conn{b: b, channels: make(map[*Channel]bool)}
+	b.conns[c] = true
+	return c, nil
+}
+
+// RefuseDial makes the next dials fail with the error, nil accepts them again
+func (b *Broker) RefuseDial(err error) {
+	b.mu.Lock()
+	b.dialErr = err
+	b.mu.Unlock()
+}
+
+// RefusePublish makes Publish fail with the error, nil accepts the messages again
+func (b *Broker) RefusePublish(err error) {
+	b.mu.Lock()
+	b.publishErr = err
+	b.mu.Unlock()
+}
+
+// DropConnections closes all connections with the connection forced error,
+// the unacked messages are requeued
+func (b *Broker) DropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.shutdown(&amqp_driver.Error{
+			Code:   amqp_driver.ConnectionForced,
+			Reason: "amqptest: connection dropped",
+		})
+	}
+}
+
+// Dials returns the count of the dial attempts
+func (b *Broker) Dials() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+// Connections returns the count of the open connections
+func (b *Broker) Connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// Published returns the count of the accepted publishes
+func (b *Broker) Published() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.published
+}
+
+// Queue returns the ready messages and consumers count of the queue
+func (b *Broker) Queue(name string) (amqp_driver.Queue, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp_driver.Queue{}, false
+	}
+	return q.state(), true
+}
+
+// Messages returns the ready messages of the queue in the delivery order
+func (b *Broker) Messages(name string) []amqp_driver.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return nil
+	}
+	msgs := make([]amqp_driver.Publishing, 0, len(q.ready))
+	for _, m := range q.ready {
+		msgs = append(msgs, m.p)
+	}
+	return msgs
+}
+
+// Inject puts the message to the queue, the queue is declared if not found
+func (b *Broker) Inject(name string, p amqp_driver.Publishing) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.queues[name]; !ok {
+		b.queues[name] = &queue{name: name}
+	}
+	b.route("", name, p)
+}
+
+func (q *queue) state() amqp_driver.Queue {
+	return amqp_driver.Queue{
+		Name:      q.name,
+		Messages:  len(q.ready),
+		Consumers: len(q.consumers),
+	}
+}
+
+func (q *queue) maxPriority() uint8 {
+	switch v := q.args["x-max-priority"].(type) {
+	case int32:
+		return uint8(v)
+	case int64:
+		return uint8(v)
+	case int:
+		return uint8(v)
+	case uint8:
+		return v
+	}
+	return 0
+}
+
+func (q *queue) ttl() time.Duration {
+	switch v := q.args["x-message-ttl"].(type) {
+	case int32:
+		return time.Duration(v) * time.Millisecond
+	case int64:
+		return time.Duration(v) * time.Millisecond
+	case int:
+		return time.Duration(v) * time.Millisecond
+	}
+	return 0
+}
+
+// push keeps the higher priority first in the priority queue
+func (q *queue) push(m message, front bool) {
+	max := q.maxPriority()
+	if max == 0 {
+		if front {
+			q.ready = append([]message{m}, q.ready...)
+		} else {
+			q.ready = append(q.ready, m)
+		}
+		return
+	}
+	priority := m.p.Priority
+	if priority > max {
+		priority = max
+	}
+	i := 0
+	for ; i < len(q.ready); i++ {
+		p := q.ready[i].p.Priority
+		if p > max {
+			p = max
+		}
+		if p < priority || (front && p == priority) {
+			break
+		}
+	}
+	q.ready = append(q.ready, message{})
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = m
+}
+
+func (q *queue) remove(id uint64) (message, bool) {
+	for i, m := range q.ready {
+		if m.id == id {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			return m, true
+		}
+	}
+	return message{}, false
+}
+
+// route delivers the message to the queues of the exchange, the unroutable message is dropped
+func (b *Broker) route(exchangeName, key string, p amqp_driver.Publishing) {
+	if exchangeName == "" {
+		if q, ok := b.queues[key]; ok {
+			b.enqueue(q, message{p: p, exchange: exchangeName, key: key})
+		}
+		return
+	}
+	e, ok := b.exchanges[exchangeName]
+	if !ok {
+		return
+	}
+	if e.kind == "x-delayed-message" {
+		if delay := headerDuration(p.Headers["x-delay"]); delay > 0 {
+			time.AfterFunc(delay, func() {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				b.routeBindings(e, key, p)
+			})
+			return
+		}
+	}
+	b.routeBindings(e, key, p)
+}
+
+func (b *Broker) routeBindings(e *exchange, key string, p amqp_driver.Publishing) {
+	for _, bind := range e.bindings {
+		if e.kind == "fanout" || bind.key == key {
+			if q, ok := b.queues[bind.queue]; ok {
+				b.enqueue(q, message{p: p, exchange: e.name, key: key})
+			}
+		}
+	}
+}
+
+func headerDuration(v interface{}) time.Duration {
+	switch d := v.(type) {
+	case int32:
+		return time.Duration(d) * time.Millisecond
+	case int64:
+		return time.Duration(d) * time.Millisecond
+	case int:
+		return time.Duration(d) * time.Millisecond
+	}
+	return 0
+}
+
+func (b *Broker) enqueue(q *queue, m message) {
+	b.seq++
+	m.id = b.seq
+	q.push(m, false)
+	if ttl := q.ttl(); ttl > 0 {
+		id := m.id
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if expired, ok := q.remove(id); ok {
+				b.deadLetter(q, expired)
+			}
+		})
+	}
+	b.dispatch(q)
+}
+
+// deadLetter routes the expired or rejected message to the dead letter exchange of the queue
+func (b *Broker) deadLetter(q *queue, m message) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+	b.route(dlx, key, m.p)
+}
+
+// dispatch sends the ready messages to the consumers having room by prefetch
+func (b *Broker) dispatch(q *queue) {
+	for len(q.ready) > 0 && len(q.consumers) > 0 {
+		var c *consumer
+		for i := 0; i < len(q.consumers); i++ {
+			candidate := q.consumers[(q.next+i)%len(q.consumers)]
+			if candidate.hasRoom() {
+				c = candidate
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+		c.deliver(q, m)
+	}
+}
+
+func (b *Broker) dispatchAll() {
+	for _, q := range b.queues {
+		b.dispatch(q)
+	}
+}
+
+func channelError(code int, format string, args ...interface{}) *amqp_driver.Error {
+	return &amqp_driver.Error{
+		Code:    code,
+		Reason:  fmt.Sprintf(format, args...),
+		Server:  true,
+		Recover: false,
+	}
+}
@@ -0,0 +1,231 @@
+package amqptest_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/amqp"
+	"github.com/linkit360/go-utils/amqp/amqptest"
+	"github.com/linkit360/go-utils/config"
+)
+
+func newConnection(t *testing.T, b *amqptest.Broker) *amqp.Connection {
+	conn := amqp.NewConnectionWithDialer(amqp.ConnectionConfig{
+		URI: "amqp://test",
+	}, 0, b.Dial)
+	select {
+	case <-conn.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("connection is not ready")
+	}
+	return conn
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotifierReconnect(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	n := amqp.NewNotifierWithConnection(conn, amqp.NotifierConfig{ChanCapacity: 100, PublishChannels: 2})
+	defer n.Close()
+
+	n.Publish(amqp.AMQPMessage{QueueName: "q", Body: []byte("first")})
+	eventually(t, "first message published", func() bool {
+		q, _ := b.Queue("q")
+		return q.Messages == 1
+	})
+
+	b.DropConnections()
+	eventually(t, "reconnected", func() bool {
+		return b.Connections() == 1
+	})
+	n.Publish(amqp.AMQPMessage{QueueName: "q", Body: []byte("second")})
+	eventually(t, "published after reconnect", func() bool {
+		q, _ := b.Queue("q")
+		return q.Messages == 2
+	})
+}
+
+// the messages published while the channels are closed are requeued and published once
+func TestPublishDuringChannelClose(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	n := amqp.NewNotifierWithConnection(conn, amqp.NotifierConfig{ChanCapacity: 1000, PublishChannels: 2})
+	defer n.Close()
+
+	const count = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			n.Publish(amqp.AMQPMessage{QueueName: "q", Body: []byte(fmt.Sprintf("%d", i))})
+			if i == count/2 {
+				b.DropConnections()
+			}
+		}
+	}()
+	wg.Wait()
+
+	eventually(t, "all messages published", func() bool {
+		q, _ := b.Queue("q")
+		return q.Messages == count
+	})
+	seen := make(map[string]bool)
+	for _, p := range b.Messages("q") {
+		seen[string(p.Body)] = true
+	}
+	if len(seen) != count {
+		t.Fatalf("got %d distinct messages, want %d", len(seen), count)
+	}
+	eventually(t, "buffers drained", func() bool {
+		return n.Buffered() == 0
+	})
+}
+
+// Close stops the publishers, the messages buffered after it stay in the buffer
+func TestNotifierClose(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	n := amqp.NewNotifierWithConnection(conn, amqp.NotifierConfig{ChanCapacity: 100, PublishChannels: 3})
+
+	n.Publish(amqp.AMQPMessage{QueueName: "q", Body: []byte("before")})
+	eventually(t, "published before close", func() bool {
+		return n.Buffered() == 0
+	})
+	closed := make(chan struct{})
+	go func() {
+		n.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close does not return")
+	}
+
+	n.Publish(amqp.AMQPMessage{QueueName: "q", Body: []byte("after")})
+	time.Sleep(100 * time.Millisecond)
+	if q, _ := b.Queue("q"); q.Messages != 1 {
+		t.Fatalf("got %d messages, want 1", q.Messages)
+	}
+	if n.Buffered() != 1 {
+		t.Fatalf("buffered %d, want 1", n.Buffered())
+	}
+}
+
+func TestConsumerResubscribe(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	c := amqp.NewConsumerWithConnection(conn, amqp.ConsumerConfig{PollInterval: 1}, "tq", 1)
+	defer c.Close()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 10)
+	amqp.InitQueue(c, nil, func(deliveries <-chan amqp_driver.Delivery) {
+		for d := range deliveries {
+			got <- string(d.Body)
+			d.Ack(false)
+		}
+	}, 1, "tq", "tq")
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case body := <-got:
+			if body != want {
+				t.Fatalf("got %s, want %s", body, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout: %s", want)
+		}
+	}
+
+	b.Inject("tq", amqp_driver.Publishing{Body: []byte("before")})
+	receive("before")
+
+	b.DropConnections()
+	eventually(t, "consumer resubscribed", func() bool {
+		q, _ := b.Queue("tq")
+		return q.Consumers == 1
+	})
+	b.Inject("tq", amqp_driver.Publishing{Body: []byte("after")})
+	receive("after")
+}
+
+// the deliveries waiting for the busy handler are taken by priority
+func TestConsumerPriority(t *testing.T) {
+	b := amqptest.NewBroker()
+	conn := newConnection(t, b)
+	defer conn.Close()
+	var topology config.Topology
+	topology.Add(config.TopologyQueue{Name: "pq", Options: config.QueueOptions{MaxPriority: 10}})
+	if err := conn.DeclareTopology(topology); err != nil {
+		t.Fatal(err)
+	}
+	c := amqp.NewConsumerWithConnection(conn, amqp.ConsumerConfig{PollInterval: 1}, "pq", 10)
+	defer c.Close()
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	got := make(chan string, 10)
+	amqp.InitQueue(c, nil, func(deliveries <-chan amqp_driver.Delivery) {
+		for d := range deliveries {
+			if string(d.Body) == "busy" {
+				<-release
+			}
+			got <- string(d.Body)
+			d.Ack(false)
+		}
+	}, 1, "pq", "pq")
+
+	b.Inject("pq", amqp_driver.Publishing{Body: []byte("busy")})
+	eventually(t, "handler is busy", func() bool {
+		q, _ := b.Queue("pq")
+		return q.Messages == 0
+	})
+	for _, p := range []struct {
+		body     string
+		priority uint8
+	}{{"low", 1}, {"normal", 5}, {"high", 9}, {"normal2", 5}} {
+		b.Inject("pq", amqp_driver.Publishing{Body: []byte(p.body), Priority: p.priority})
+	}
+	// the prefetched deliveries wait in the pool
+	eventually(t, "deliveries prefetched", func() bool {
+		q, _ := b.Queue("pq")
+		return q.Messages == 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	for _, want := range []string{"busy", "high", "normal", "normal2", "low"} {
+		select {
+		case body := <-got:
+			if body != want {
+				t.Fatalf("got %s, want %s", body, want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout: %s", want)
+		}
+	}
+}
@@ -0,0 +1,567 @@
+package amqptest
+
+import (
+	"fmt"
+	"sync"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/amqp"
+)
+
+// Conn implements amqp.Conn
+type Conn struct {
+	b        *Broker
+	channels map[*Channel]bool
+	notify   []chan *amqp_driver.Error
+	closed   bool
+}
+
+func (c *Conn) Channel() (amqp.Channel, error) {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		return nil, amqp_driver.ErrClosed
+	}
+	ch := &Channel{
+		b:       c.b,
+		conn:    c,
+		unacked: make(map[uint64]*unacked),
+	}
+	c.channels[ch] = true
+	return ch, nil
+}
+
+func (c *Conn) NotifyClose(receiver chan *amqp_driver.Error) chan *amqp_driver.Error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *Conn) Close() error {
+	c.b.mu.Lock()
+	defer c.b.mu.Unlock()
+	if c.closed {
+		return amqp_driver.ErrClosed
+	}
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown is called under the broker lock, nil error is the graceful close
+func (c *Conn) shutdown(err *amqp_driver.Error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for ch := range c.channels {
+		ch.shutdown(err)
+	}
+	notifyClosed(c.notify, err)
+	c.notify = nil
+	delete(c.b.conns, c)
+}
+
+// notifyClosed sends the error and closes the receivers without blocking the broker
+func notifyClosed(receivers []chan *amqp_driver.Error, err *amqp_driver.Error) {
+	for _, r := range receivers {
+		go func(r chan *amqp_driver.Error) {
+			if err != nil {
+				r <- err
+			}
+			close(r)
+		}(r)
+	}
+}
+
+type unacked struct {
+	q *queue
+	m message
+	c *consumer
+}
+
+// Channel implements amqp.Channel
+type Channel struct {
+	b         *Broker
+	conn      *Conn
+	notify    []chan *amqp_driver.Error
+	closed    bool
+	prefetch  int
+	global    bool
+	tag       uint64
+	unacked   map[uint64]*unacked
+	consumers []*consumer
+	// publisher confirms, sent under the broker lock,
+	// so the receivers are buffered or read after every publish
+	confirming bool
+	published  uint64
+	confirms   []chan amqp_driver.Confirmation
+}
+
+// fail closes the channel with the error like rabbit does on the channel exceptions
+func (ch *Channel) fail(err *amqp_driver.Error) error {
+	ch.shutdown(err)
+	return err
+}
+
+func (ch *Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp_driver.Table) (amqp_driver.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.Queue{}, amqp_driver.ErrClosed
+	}
+	if q, ok := ch.b.queues[name]; ok {
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive || !sameArgs(q.args, args) {
+			return amqp_driver.Queue{}, ch.fail(channelError(amqp_driver.PreconditionFailed,
+				"PRECONDITION_FAILED - inequivalent arg for queue '%s'", name))
+		}
+		return q.state(), nil
+	}
+	q := &queue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	ch.b.queues[name] = q
+	return q.state(), nil
+}
+
+func sameArgs(a, b amqp_driver.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if fmt.Sprint(v) != fmt.Sprint(b[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch *Channel) QueueInspect(name string) (amqp_driver.Queue, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.Queue{}, amqp_driver.ErrClosed
+	}
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return amqp_driver.Queue{}, ch.fail(channelError(amqp_driver.NotFound,
+			"NOT_FOUND - no queue '%s'", name))
+	}
+	return q.state(), nil
+}
+
+func (ch *Channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp_driver.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	switch kind {
+	case "direct", "fanout":
+	case "x-delayed-message":
+		if !ch.b.DelayedMessagePlugin {
+			return ch.fail(channelError(amqp_driver.CommandInvalid,
+				"COMMAND_INVALID - unknown exchange type '%s'", kind))
+		}
+	default:
+		return ch.fail(channelError(amqp_driver.CommandInvalid,
+			"COMMAND_INVALID - exchange type '%s' is not supported by amqptest", kind))
+	}
+	if e, ok := ch.b.exchanges[name]; ok {
+		if e.kind != kind {
+			return ch.fail(channelError(amqp_driver.PreconditionFailed,
+				"PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name))
+		}
+		return nil
+	}
+	ch.b.exchanges[name] = &exchange{name: name, kind: kind}
+	return nil
+}
+
+func (ch *Channel) QueueBind(name, key, exchangeName string, noWait bool, args amqp_driver.Table) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	e, ok := ch.b.exchanges[exchangeName]
+	if !ok {
+		return ch.fail(channelError(amqp_driver.NotFound, "NOT_FOUND - no exchange '%s'", exchangeName))
+	}
+	if _, ok := ch.b.queues[name]; !ok {
+		return ch.fail(channelError(amqp_driver.NotFound, "NOT_FOUND - no queue '%s'", name))
+	}
+	for _, bind := range e.bindings {
+		if bind.key == key && bind.queue == name {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, binding{key: key, queue: name})
+	return nil
+}
+
+// Publish to the unknown exchange closes the channel, the unroutable message is dropped
+func (ch *Channel) Publish(exchangeName, key string, mandatory, immediate bool, msg amqp_driver.Publishing) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	if ch.b.publishErr != nil {
+		return ch.b.publishErr
+	}
+	if _, ok := ch.b.exchanges[exchangeName]; exchangeName != "" && !ok {
+		ch.shutdown(channelError(amqp_driver.NotFound, "NOT_FOUND - no exchange '%s'", exchangeName))
+		return nil
+	}
+	ch.b.published++
+	ch.b.route(exchangeName, key, msg)
+	if ch.confirming {
+		ch.published++
+		for _, c := range ch.confirms {
+			c <- amqp_driver.Confirmation{DeliveryTag: ch.published, Ack: true}
+		}
+	}
+	return nil
+}
+
+// Confirm puts the channel to the confirm mode, every accepted publish is acked
+func (ch *Channel) Confirm(noWait bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	ch.confirming = true
+	return nil
+}
+
+// NotifyPublish receiver is closed when the channel is closed
+func (ch *Channel) NotifyPublish(confirm chan amqp_driver.Confirmation) chan amqp_driver.Confirmation {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+// Get takes the head message, it is unacked till ack unless autoAck
+func (ch *Channel) Get(queueName string, autoAck bool) (amqp_driver.Delivery, bool, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.Delivery{}, false, amqp_driver.ErrClosed
+	}
+	q, ok := ch.b.queues[queueName]
+	if !ok {
+		return amqp_driver.Delivery{}, false, ch.fail(channelError(amqp_driver.NotFound, "NOT_FOUND - no queue '%s'", queueName))
+	}
+	if len(q.ready) == 0 {
+		return amqp_driver.Delivery{}, false, nil
+	}
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+	ch.tag++
+	if !autoAck {
+		ch.unacked[ch.tag] = &unacked{q: q, m: m}
+	}
+	d := delivery(ch, m, ch.tag)
+	d.MessageCount = uint32(len(q.ready))
+	return d, true, nil
+}
+
+// QueuePurge removes the ready messages, the unacked ones stay
+func (ch *Channel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp_driver.ErrClosed
+	}
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return 0, ch.fail(channelError(amqp_driver.NotFound, "NOT_FOUND - no queue '%s'", name))
+	}
+	purged := len(q.ready)
+	q.ready = nil
+	return purged, nil
+}
+
+func (ch *Channel) Consume(queueName, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp_driver.Table) (<-chan amqp_driver.Delivery, error) {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp_driver.ErrClosed
+	}
+	q, ok := ch.b.queues[queueName]
+	if !ok {
+		return nil, ch.fail(channelError(amqp_driver.NotFound, "NOT_FOUND - no queue '%s'", queueName))
+	}
+	if consumerTag == "" {
+		ch.b.seq++
+		consumerTag = fmt.Sprintf("amqptest-%d", ch.b.seq)
+	}
+	c := newConsumer(ch, consumerTag, autoAck)
+	ch.consumers = append(ch.consumers, c)
+	q.consumers = append(q.consumers, c)
+	ch.b.dispatch(q)
+	return c.out, nil
+}
+
+// Qos with global applies to all consumers of the channel together,
+// otherwise to every consumer
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	ch.global = global
+	ch.b.dispatchAll()
+	return nil
+}
+
+func (ch *Channel) NotifyClose(receiver chan *amqp_driver.Error) chan *amqp_driver.Error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		close(receiver)
+		return receiver
+	}
+	ch.notify = append(ch.notify, receiver)
+	return receiver
+}
+
+func (ch *Channel) Close() error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if ch.closed {
+		return amqp_driver.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+// shutdown requeues the unacked messages and stops the consumers
+func (ch *Channel) shutdown(err *amqp_driver.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	for tag, u := range ch.unacked {
+		delete(ch.unacked, tag)
+		u.m.redelivered = true
+		u.q.push(u.m, true)
+	}
+	for _, c := range ch.consumers {
+		c.cancel()
+	}
+	ch.consumers = nil
+	delete(ch.conn.channels, ch)
+	notifyClosed(ch.notify, err)
+	ch.notify = nil
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	ch.confirms = nil
+	ch.b.dispatchAll()
+}
+
+// settle finds the unacked deliveries of the tag
+func (ch *Channel) settle(tag uint64, multiple bool) ([]*unacked, error) {
+	if ch.closed {
+		return nil, amqp_driver.ErrClosed
+	}
+	var settled []*unacked
+	if multiple {
+		for t, u := range ch.unacked {
+			if t <= tag {
+				settled = append(settled, u)
+				delete(ch.unacked, t)
+			}
+		}
+	} else if u, ok := ch.unacked[tag]; ok {
+		settled = append(settled, u)
+		delete(ch.unacked, tag)
+	}
+	if len(settled) == 0 {
+		return nil, ch.fail(channelError(amqp_driver.PreconditionFailed,
+			"PRECONDITION_FAILED - unknown delivery tag %d", tag))
+	}
+	for _, u := range settled {
+		if u.c != nil {
+			u.c.unacked--
+		}
+	}
+	return settled, nil
+}
+
+func (ch *Channel) Ack(tag uint64, multiple bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	if _, err := ch.settle(tag, multiple); err != nil {
+		return err
+	}
+	ch.b.dispatchAll()
+	return nil
+}
+
+// Nack requeues the messages to the queue head or dead-letters them
+func (ch *Channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	ch.b.mu.Lock()
+	defer ch.b.mu.Unlock()
+	settled, err := ch.settle(tag, multiple)
+	if err != nil {
+		return err
+	}
+	for _, u := range settled {
+		if requeue {
+			u.m.redelivered = true
+			u.q.push(u.m, true)
+		} else {
+			ch.b.deadLetter(u.q, u.m)
+		}
+	}
+	ch.b.dispatchAll()
+	return nil
+}
+
+func (ch *Channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// unackedCount is the count of the channel for the global qos
+func (ch *Channel) unackedCount() int {
+	return len(ch.unacked)
+}
+
+type consumer struct {
+	ch      *Channel
+	tag     string
+	autoAck bool
+	unacked int
+	out     chan amqp_driver.Delivery
+	mu      sync.Mutex
+	buf     []amqp_driver.Delivery
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+func newConsumer(ch *Channel, tag string, autoAck bool) *consumer {
+	c := &consumer{
+		ch:      ch,
+		tag:     tag,
+		autoAck: autoAck,
+		out:     make(chan amqp_driver.Delivery),
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *consumer) hasRoom() bool {
+	if c.autoAck || c.ch.prefetch <= 0 {
+		return true
+	}
+	if c.ch.global {
+		return c.ch.unackedCount() < c.ch.prefetch
+	}
+	return c.unacked < c.ch.prefetch
+}
+
+// deliver is called under the broker lock
+func (c *consumer) deliver(q *queue, m message) {
+	c.ch.tag++
+	tag := c.ch.tag
+	if !c.autoAck {
+		c.ch.unacked[tag] = &unacked{q: q, m: m, c: c}
+		c.unacked++
+	}
+	d := delivery(c.ch, m, tag)
+	d.ConsumerTag = c.tag
+	c.mu.Lock()
+	c.buf = append(c.buf, d)
+	c.mu.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func delivery(ch *Channel, m message, tag uint64) amqp_driver.Delivery {
+	return amqp_driver.Delivery{
+		Acknowledger:    ch,
+		Headers:         m.p.Headers,
+		ContentType:     m.p.ContentType,
+		ContentEncoding: m.p.ContentEncoding,
+		DeliveryMode:    m.p.DeliveryMode,
+		Priority:        m.p.Priority,
+		CorrelationId:   m.p.CorrelationId,
+		ReplyTo:         m.p.ReplyTo,
+		Expiration:      m.p.Expiration,
+		MessageId:       m.p.MessageId,
+		Timestamp:       m.p.Timestamp,
+		Type:            m.p.Type,
+		UserId:          m.p.UserId,
+		AppId:           m.p.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.p.Body,
+	}
+}
+
+// cancel is called under the broker lock, the delivery channel is closed
+func (c *consumer) cancel() {
+	for _, q := range c.ch.b.queues {
+		for i, qc := range q.consumers {
+			if qc == c {
+				q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+				break
+			}
+		}
+	}
+	close(c.done)
+}
+
+// run sends the deliveries in order without holding the broker lock
+func (c *consumer) run() {
+	defer close(c.out)
+	for {
+		c.mu.Lock()
+		if len(c.buf) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.signal:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		d := c.buf[0]
+		c.mu.Unlock()
+
+		select {
+		case c.out <- d:
+			c.mu.Lock()
+			c.buf = c.buf[1:]
+			c.mu.Unlock()
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package amqp
+
+// the autoscaler grows or shrinks the worker pool of the consumer
+// by the queue depth and the handler latency,
+// prefetch count follows the workers count
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+// handlerStats accumulates handler latency between autoscaler ticks
+type handlerStats struct {
+	mu    sync.Mutex
+	count int64
+	total time.Duration
+}
+
+func (s *handlerStats) observe(took time.Duration) {
+	s.mu.Lock()
+	s.count++
+	s.total += took
+	s.mu.Unlock()
+}
+
+// reset returns handled count and average latency since the previous reset
+func (s *handlerStats) reset() (count int64, avg time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count = s.count
+	if count > 0 {
+		avg = s.total / time.Duration(count)
+	}
+	s.count = 0
+	s.total = 0
+	return
+}
+
+// SetAutoscale must be called before Handle
+func (c *Consumer) SetAutoscale(conf config.AutoscaleConfig) {
+	if !conf.Enabled {
+		c.autoscale = nil
+		return
+	}
+	if conf.MinThreads <= 0 {
+		conf.MinThreads = 1
+	}
+	if conf.MaxThreads < conf.MinThreads {
+		conf.MaxThreads = conf.MinThreads
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = 30
+	}
+	c.autoscale = &conf
+}
+
+// runAutoscaler resizes the pool every interval until Close
+func (c *Consumer) runAutoscaler(pool *workerPool, queue string) {
+	conf := *c.autoscale
+	interval := time.Duration(conf.Interval) * time.Second
+
+	c.every(interval, func() {
+		queueInfo, err := c.inspect(queue)
+		if err != nil {
+			return
+		}
+		handled, avg := pool.stats.reset()
+		current := pool.size()
+		desired := desiredWorkers(conf, current, queueInfo.Messages, handled, avg, interval)
+		if desired == current {
+			return
+		}
+
+		pool.resize(desired)
+		if conf.PrefetchPerThread > 0 {
+			c.setPrefetch(desired * conf.PrefetchPerThread)
+		}
+		log.WithFields(log.Fields{
+			"queue":   queue,
+			"depth":   queueInfo.Messages,
+			"handled": handled,
+			"latency": avg,
+			"from":    current,
+			"to":      desired,
+		}).Info("rbmq consumer: autoscale")
+	})
+}
+
+// desiredWorkers keeps up with the incoming rate and drains the queue depth in one interval,
+// it grows at once and shrinks by a quarter at most to avoid flapping
+func desiredWorkers(conf config.AutoscaleConfig, current, depth int, handled int64, avg, interval time.Duration) int {
+	var desired int
+	switch {
+	case depth == 0 && handled == 0:
+		desired = conf.MinThreads
+	case avg == 0:
+		// nothing handled yet, but the queue grows
+		desired = current * 2
+	default:
+		busy := float64(handled) * avg.Seconds() / interval.Seconds()
+		backlog := float64(depth) * avg.Seconds() / interval.Seconds()
+		desired = int(math.Ceil(busy + backlog))
+	}
+
+	if minimum := current - int(math.Ceil(float64(current)/4)); desired < minimum {
+		desired = minimum
+	}
+	if desired < conf.MinThreads {
+		desired = conf.MinThreads
+	}
+	if desired > conf.MaxThreads {
+		desired = conf.MaxThreads
+	}
+	return desired
+}
+
+// setPrefetch changes the prefetch of the current channel,
+// the qos is global for the channel when autoscaling, so it applies to the running consumer
+func (c *Consumer) setPrefetch(prefetch int) {
+	c.mu.Lock()
+	c.queuePrefetchCount = prefetch
+	ch := c.channel
+	c.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	if err := ch.Qos(prefetch, 0, true); err != nil {
+		log.WithFields(log.Fields{
+			"prefetch": prefetch,
+			"error":    err.Error(),
+		}).Error("rbmq consumer: set qos")
+	}
+}
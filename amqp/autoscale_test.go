@@ -0,0 +1,54 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+func TestDesiredWorkers(t *testing.T) {
+	conf := config.AutoscaleConfig{MinThreads: 2, MaxThreads: 20}
+	interval := 10 * time.Second
+	tests := []struct {
+		name    string
+		current int
+		depth   int
+		handled int64
+		avg     time.Duration
+		want    int
+	}{
+		{"idle shrinks by a quarter", 10, 0, 0, 0, 7},
+		{"idle keeps the minimum", 2, 0, 0, 0, 2},
+		{"queue grows without latency", 4, 100, 0, 0, 8},
+		{"doubling is capped", 15, 100, 0, 0, 20},
+		{"rate and backlog", 10, 50, 100, time.Second, 15},
+		{"slow shrink", 16, 0, 10, time.Second, 12},
+		{"capped by max", 10, 0, 1000, time.Second, 20},
+		{"raised to min", 2, 0, 1, time.Millisecond, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := desiredWorkers(conf, tt.current, tt.depth, tt.handled, tt.avg, interval)
+			if got != tt.want {
+				t.Fatalf("desiredWorkers(current %d, depth %d, handled %d, avg %s) = %d, want %d",
+					tt.current, tt.depth, tt.handled, tt.avg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerStats(t *testing.T) {
+	var s handlerStats
+	if count, avg := s.reset(); count != 0 || avg != 0 {
+		t.Fatalf("empty stats: %d, %s", count, avg)
+	}
+	s.observe(time.Second)
+	s.observe(3 * time.Second)
+	if count, avg := s.reset(); count != 2 || avg != 2*time.Second {
+		t.Fatalf("got %d, %s, want 2, 2s", count, avg)
+	}
+	if count, _ := s.reset(); count != 0 {
+		t.Fatalf("not reset: %d", count)
+	}
+}
@@ -0,0 +1,179 @@
+package amqp
+
+// codecs encode the message body, the codec is selected by the content type,
+// so the consumer decodes the message by its header whatever the producer uses.
+// text/plain is the json published before the codecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	amqp_driver "github.com/streadway/amqp"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	ContentTypeText     = "text/plain"
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/protobuf"
+)
+
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct {
+	contentType string
+}
+
+func (c jsonCodec) ContentType() string                        { return c.contentType }
+func (c jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (c jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec uses json tags, so the structs keep the same field names
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf).UseJSONTag(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.UseJSONTag(true)
+	return dec.Decode(v)
+}
+
+// protobufCodec requires the generated proto.Message types
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Marshal(pb)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	pb, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, pb)
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{contentType: ContentTypeJSON}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+	// TextCodec is json labelled text/plain, the default of the notifier
+	TextCodec Codec = jsonCodec{contentType: ContentTypeText}
+)
+
+var codecsMu sync.RWMutex
+var codecs = map[string]Codec{
+	ContentTypeText:          TextCodec,
+	ContentTypeJSON:          JSONCodec,
+	ContentTypeMsgpack:       MsgpackCodec,
+	"application/x-msgpack":  MsgpackCodec,
+	ContentTypeProtobuf:      ProtobufCodec,
+	"application/x-protobuf": ProtobufCodec,
+}
+
+// RegisterCodec adds or replaces the codec of its content type
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.ContentType()] = c
+	codecsMu.Unlock()
+}
+
+// CodecFor returns the codec of the content type, empty content type is json
+func CodecFor(contentType string) (Codec, error) {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	if contentType == "" {
+		return TextCodec, nil
+	}
+	codecsMu.RLock()
+	c, ok := codecs[contentType]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no codec for content type %s", contentType)
+	}
+	return c, nil
+}
+
+// Decode unmarshals the delivery body with the codec of its content type
+func Decode(d amqp_driver.Delivery, v interface{}) error {
+	c, err := CodecFor(d.ContentType)
+	if err != nil {
+		return err
+	}
+	if err = c.Unmarshal(d.Body, v); err != nil {
+		return fmt.Errorf("%s unmarshal: %s", c.ContentType(), err.Error())
+	}
+	return nil
+}
+
+// codecFor returns the codec of the queue, the queue content types override the notifier one
+func (n *Notifier) codecFor(queue string) (Codec, error) {
+	if contentType, ok := n.conf.QueueContentTypes[queue]; ok {
+		return CodecFor(contentType)
+	}
+	if n.codec != nil {
+		return n.codec, nil
+	}
+	return CodecFor(n.conf.ContentType)
+}
+
+// SetCodec sets the codec of the queues without content type in config
+func (n *Notifier) SetCodec(c Codec) {
+	n.codec = c
+}
+
+// Encode marshals the value to the message with the codec of the queue,
+// the value is EventNotify for json and msgpack, the generated message for protobuf
+func (n *Notifier) Encode(queue, eventName string, v interface{}) (AMQPMessage, error) {
+	c, err := n.codecFor(queue)
+	if err != nil {
+		return AMQPMessage{}, err
+	}
+	body, err := c.Marshal(v)
+	if err != nil {
+		return AMQPMessage{}, fmt.Errorf("%s marshal: %s", c.ContentType(), err.Error())
+	}
+	return AMQPMessage{
+		QueueName:   queue,
+		Body:        body,
+		EventName:   eventName,
+		ContentType: c.ContentType(),
+	}, nil
+}
+
+// PublishEvent encodes and publishes the value
+func (n *Notifier) PublishEvent(queue, eventName string, v interface{}) error {
+	msg, err := n.Encode(queue, eventName, v)
+	if err != nil {
+		return err
+	}
+	return n.PublishContext(context.Background(), msg)
+}
@@ -0,0 +1,110 @@
+package amqp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	amqp_driver "github.com/streadway/amqp"
+)
+
+type codecEvent struct {
+	EventName string            `json:"event_name" msgpack:"event_name"`
+	EventData map[string]string `json:"event_data" msgpack:"event_data"`
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        Codec
+	}{
+		{"", TextCodec},
+		{"text/plain", TextCodec},
+		{"application/json", JSONCodec},
+		{"Application/JSON; charset=utf-8", JSONCodec},
+		{"application/msgpack", MsgpackCodec},
+		{"application/x-msgpack", MsgpackCodec},
+		{"application/protobuf", ProtobufCodec},
+		{"application/x-protobuf", ProtobufCodec},
+	}
+	for _, tt := range tests {
+		got, err := CodecFor(tt.contentType)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.contentType, err.Error())
+		}
+		if got != tt.want {
+			t.Fatalf("%q: got %s codec, want %s", tt.contentType, got.ContentType(), tt.want.ContentType())
+		}
+	}
+	if _, err := CodecFor("application/xml"); err == nil {
+		t.Fatal("codec for unknown content type")
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	event := codecEvent{EventName: "charge", EventData: map[string]string{"msisdn": "7999"}}
+	for _, codec := range []Codec{TextCodec, JSONCodec, MsgpackCodec} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			body, err := codec.Marshal(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got codecEvent
+			if err = Decode(amqp_driver.Delivery{ContentType: codec.ContentType(), Body: body}, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, event) {
+				t.Fatalf("got %+v, want %+v", got, event)
+			}
+		})
+	}
+
+	t.Run(ContentTypeProtobuf, func(t *testing.T) {
+		body, err := ProtobufCodec.Marshal(&wrappers.StringValue{Value: "7999"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got wrappers.StringValue
+		if err = Decode(amqp_driver.Delivery{ContentType: ContentTypeProtobuf, Body: body}, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != "7999" {
+			t.Fatalf("got %q", got.Value)
+		}
+		if _, err = ProtobufCodec.Marshal(event); err == nil {
+			t.Fatal("protobuf marshals not proto.Message")
+		}
+	})
+}
+
+// the notifier encodes with the queue content type over its own
+func TestNotifierEncode(t *testing.T) {
+	n := &Notifier{conf: NotifierConfig{
+		ContentType:       ContentTypeText,
+		QueueContentTypes: map[string]string{"packed": ContentTypeMsgpack},
+	}}
+	tests := []struct {
+		queue       string
+		contentType string
+	}{
+		{"plain", ContentTypeText},
+		{"packed", ContentTypeMsgpack},
+	}
+	for _, tt := range tests {
+		msg, err := n.Encode(tt.queue, "charge", EventNotify{EventName: "charge", EventData: map[string]string{"msisdn": "7999"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ContentType != tt.contentType || msg.QueueName != tt.queue || msg.EventName != "charge" {
+			t.Fatalf("%s: got %s %s %s", tt.queue, msg.QueueName, msg.ContentType, msg.EventName)
+		}
+		var got EventNotify
+		if err = Decode(amqp_driver.Delivery{ContentType: msg.ContentType, Body: msg.Body}, &got); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := got.EventData.(map[string]interface{})
+		if got.EventName != "charge" || data["msisdn"] != "7999" {
+			t.Fatalf("%s: decoded %+v", tt.queue, got)
+		}
+	}
+}
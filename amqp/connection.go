@@ -0,0 +1,341 @@
+package amqp
+
+// Connection holds one dialled connection to rabbit.
+// Notifiers and consumers open their channels on it,
+// so a service with many queues keeps one tcp connection.
+// When the connection is lost, it reconnects, re-declares the topology
+// and the channel owners re-open their channels once it is Ready.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+	"github.com/linkit360/go-utils/metrics"
+)
+
+type ConnectionMetrics struct {
+	Connected      prometheus.Gauge
+	ReconnectCount prometheus.Gauge
+}
+
+// initConnectionMetrics reuses the registered gauges, the shared connections report to the same gauges
+func initConnectionMetrics(r *metrics.Registry) ConnectionMetrics {
+	return ConnectionMetrics{
+		Connected:      r.PrometheusGauge("rbmq", "connection", "connected", "rbmq shared connection status"),
+		ReconnectCount: r.PrometheusGauge("rbmq", "connection", "reconnect_count", "rbmq shared connection attempts count"),
+	}
+}
+
+type Connection struct {
+	urls           []string
+	dialConf       amqp_driver.Config
+	reconnectDelay int
+	m              ConnectionMetrics
+	reg            *metrics.Registry // of the components on the connection
+	mu             sync.Mutex
+	conn           Conn
+	dialer         Dialer
+	ready          chan struct{} // closed when connected
+	topology       *config.Topology
+	declared       map[string]bool      // queues declared on this connection
+	declaredAt     map[string]time.Time // delay queues and exchanges declared on this connection
+	closed         bool
+}
+
+// NewConnection dials the connection to be shared
+// between notifiers and consumers created with it
+func NewConnection(conf ConnectionConfig, reconnectDelay int) *Connection {
+	c := newConnection(conf, reconnectDelay, initConnectionMetrics(metrics.NewRegistry(conf.Registerer)))
+	<-c.Ready()
+	return c
+}
+
+// NewConnectionWithDialer does not wait for the connection, use Ready for it.
+// amqptest.Broker.Dial runs the connection against the in-memory broker
+func NewConnectionWithDialer(conf ConnectionConfig, reconnectDelay int, dialer Dialer) *Connection {
+	return newConnectionWithDialer(conf, reconnectDelay, initConnectionMetrics(metrics.NewRegistry(conf.Registerer)), dialer)
+}
+
+// newConnection starts reconnecting in background if the first dial failed
+func newConnection(conf ConnectionConfig, reconnectDelay int, m ConnectionMetrics) *Connection {
+	return newConnectionWithDialer(conf, reconnectDelay, m, DialDriver)
+}
+
+func newConnectionWithDialer(conf ConnectionConfig, reconnectDelay int, m ConnectionMetrics, dialer Dialer) *Connection {
+	urls, err := conf.urls()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("rbmq connection config")
+	}
+	dialConf, err := conf.dialConfig()
+	if err != nil {
+		log.WithField("error", err.Error()).Fatal("rbmq connection config")
+	}
+
+	c := &Connection{
+		urls:           urls,
+		dialConf:       dialConf,
+		reconnectDelay: reconnectDelay,
+		m:              m,
+		reg:            metrics.NewRegistry(conf.Registerer),
+		dialer:         dialer,
+		ready:          make(chan struct{}),
+	}
+	if err := c.connect(); err != nil {
+		log.WithField("error", err.Error()).Error("rbmq connect error")
+		go c.reConnect()
+	}
+	return c
+}
+
+// connect dials without the lock, so Ready and Channel do not wait for the cluster timeouts
+func (c *Connection) connect() error {
+	c.mu.Lock()
+	if c.conn != nil || c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	topology := c.topology
+	c.mu.Unlock()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	if topology != nil {
+		if err = declareTopologyOn(conn, *topology); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the topology is set while dialing, it is declared without the lock too
+	for c.conn == nil && !c.closed && c.topology != nil && c.topology != topology {
+		topology = c.topology
+		c.mu.Unlock()
+		err = declareTopologyOn(conn, *topology)
+		c.mu.Lock()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if c.conn != nil || c.closed {
+		conn.Close()
+		return nil
+	}
+
+	c.declared = make(map[string]bool)
+	c.declaredAt = make(map[string]time.Time)
+	if c.topology != nil {
+		for _, q := range c.topology.Queues {
+			c.declared[q.Name] = true
+		}
+	}
+	c.conn = conn
+	close(c.ready)
+	c.m.Connected.Set(1)
+	go c.watch(conn)
+	return nil
+}
+
+// dial tries the cluster nodes in order, the first one reached wins
+func (c *Connection) dial() (conn Conn, err error) {
+	for i, url := range c.urls {
+		conn, err = c.dialer(url, c.dialConf)
+		if err == nil {
+			return conn, nil
+		}
+		log.WithFields(log.Fields{
+			"node":  i,
+			"error": err.Error(),
+		}).Error("rbmq dial failed")
+	}
+	return nil, fmt.Errorf("Dial: %s", err)
+}
+
+func (c *Connection) watch(conn Conn) {
+	// Waits here for the connection to be closed
+	closeErr := <-conn.NotifyClose(make(chan *amqp_driver.Error, 1))
+
+	c.mu.Lock()
+	c.conn = nil
+	c.ready = make(chan struct{})
+	closed := c.closed
+	c.mu.Unlock()
+
+	c.m.Connected.Set(0)
+	if closed {
+		log.Info("rbmq connection closed")
+		return
+	}
+	log.Info("rbmq connection closing: ", closeErr)
+	c.reConnect()
+}
+
+func (c *Connection) reConnect() {
+	for {
+		log.WithField("reconnectDelay", c.reconnectDelay).Info("rbmq reconnects...")
+		time.Sleep(time.Duration(c.reconnectDelay) * time.Second)
+		if c.isClosed() {
+			log.Info("rbmq connection closed, reconnect stopped")
+			return
+		}
+
+		if err := c.connect(); err != nil {
+			c.m.Connected.Set(0)
+			c.m.ReconnectCount.Inc()
+			log.WithField("error", err.Error()).Error("rbmq could not reconnect")
+		} else {
+			log.Info("rbmq reconnected")
+			break
+		}
+	}
+	c.m.ReconnectCount.Set(0)
+}
+
+// Connected reports the connection is up,
+// the health checks of the notifiers and consumers on it use it
+func (c *Connection) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Ready returns the channel closed when the connection is up
+func (c *Connection) Ready() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready
+}
+
+// Channel opens a new channel, it fails if the connection is not up
+func (c *Connection) Channel() (Channel, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, amqp_driver.ErrClosed
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+	return ch, nil
+}
+
+// DeclareTopology declares the queues now and after every reconnect
+// the declare is done without the lock, so Ready and Channel do not wait for it
+func (c *Connection) DeclareTopology(t config.Topology) error {
+	c.mu.Lock()
+	c.topology = &t
+	conn, declared := c.conn, c.declared
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err := declareTopologyOn(conn, t); err != nil {
+		return err
+	}
+	// the cache of the connection declared on, a reconnect has made a new one
+	c.mu.Lock()
+	for _, q := range t.Queues {
+		declared[q.Name] = true
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// declareQueue declares the queue once per connection,
+// the cache is dropped on reconnect
+func (c *Connection) declareQueue(ch Channel, name string) error {
+	c.mu.Lock()
+	declared := c.declared
+	found := declared[name]
+	topology := c.topology
+	c.mu.Unlock()
+	if found {
+		return nil
+	}
+
+	if _, err := queueDeclare(ch, name, topology); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	declared[name] = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Connection) isDeclared(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.declared[name]
+}
+
+func (c *Connection) markDeclared(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.declared != nil {
+		c.declared[name] = true
+	}
+}
+
+// declareFresh runs declare once per connection,
+// and again when maxAge passed since the previous declare if maxAge is set
+func (c *Connection) declareFresh(key string, maxAge time.Duration, declare func() error) error {
+	c.mu.Lock()
+	declaredAt := c.declaredAt
+	at, found := declaredAt[key]
+	c.mu.Unlock()
+	if found && (maxAge == 0 || time.Since(at) < maxAge) {
+		return nil
+	}
+
+	if err := declare(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	declaredAt[key] = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Connection) Topology() *config.Topology {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topology
+}
+
+func (c *Connection) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+func declareTopologyOn(conn Conn, t config.Topology) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel: %s", err)
+	}
+	defer ch.Close()
+	return DeclareTopology(ch, t)
+}
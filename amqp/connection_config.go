@@ -0,0 +1,155 @@
+package amqp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp_driver "github.com/streadway/amqp"
+)
+
+// ConnectionConfig describes how to reach rabbit.
+// URI, if set, is used as is, otherwise it is built from the fields.
+// The password is taken from the environment variable PassEnv,
+// or from the file PassFile, or from Pass, in this order.
+// The variable PassEnv must be set when PassEnv is configured.
+type ConnectionConfig struct {
+	URI       string    `yaml:"uri"`
+	User      string    `yaml:"user" default:"linkit"`
+	Pass      string    `yaml:"pass"`
+	PassEnv   string    `yaml:"pass_env"`
+	PassFile  string    `yaml:"pass_file"`
+	Host      string    `yaml:"host" default:"localhost"`
+	Port      string    `yaml:"port"`  // 5672, 5671 with tls
+	Hosts     []string  `yaml:"hosts"` // cluster nodes as host:port, tried in order
+	Vhost     string    `yaml:"vhost" default:"/"`
+	Heartbeat int       `yaml:"heartbeat" default:"10"` // seconds
+	Name      string    `yaml:"name"`                   // connection name shown in management UI
+	TLS       TLSConfig `yaml:"tls"`
+	// metrics of the connection and of the notifiers and consumers on it,
+	// nil is the default registerer
+	Registerer prometheus.Registerer `yaml:"-"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `yaml:"enabled" default:"false"`
+	CACert             string `yaml:"ca_cert"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" default:"false"`
+}
+
+// urls returns the url for every host, in order of the failover
+func (c ConnectionConfig) urls() ([]string, error) {
+	if c.URI != "" {
+		return []string{c.URI}, nil
+	}
+
+	pass, err := c.password()
+	if err != nil {
+		return nil, err
+	}
+	scheme := "amqp"
+	if c.TLS.Enabled {
+		scheme = "amqps"
+	}
+	vhost := ""
+	if c.Vhost != "" && c.Vhost != "/" {
+		vhost = "/" + url.PathEscape(c.Vhost)
+	}
+
+	hosts := c.Hosts
+	if len(hosts) == 0 {
+		port := c.Port
+		if port == "" {
+			port = "5672"
+			if c.TLS.Enabled {
+				port = "5671"
+			}
+		}
+		hosts = []string{net.JoinHostPort(c.Host, port)}
+	}
+	urls := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		urls = append(urls, fmt.Sprintf("%s://%s@%s%s",
+			scheme,
+			url.UserPassword(c.User, pass).String(),
+			host,
+			vhost,
+		))
+	}
+	return urls, nil
+}
+
+func (c ConnectionConfig) password() (string, error) {
+	if c.PassEnv != "" {
+		pass, ok := os.LookupEnv(c.PassEnv)
+		if !ok {
+			return "", fmt.Errorf("pass_env: %s is not set", c.PassEnv)
+		}
+		return pass, nil
+	}
+	if c.PassFile != "" {
+		content, err := ioutil.ReadFile(c.PassFile)
+		if err != nil {
+			return "", fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return c.Pass, nil
+}
+
+func (c ConnectionConfig) dialConfig() (amqp_driver.Config, error) {
+	conf := amqp_driver.Config{
+		Heartbeat: time.Duration(c.Heartbeat) * time.Second,
+		Locale:    "en_US",
+	}
+	if c.Name != "" {
+		conf.Properties = amqp_driver.Table{
+			"connection_name": c.Name,
+		}
+	}
+	if !c.TLS.Enabled {
+		return conf, nil
+	}
+
+	tlsConf, err := c.TLS.tlsConfig()
+	if err != nil {
+		return conf, err
+	}
+	conf.TLSClientConfig = tlsConf
+	return conf, nil
+}
+
+func (t TLSConfig) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CACert != "" {
+		ca, err := ioutil.ReadFile(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CACert)
+		}
+	}
+	if t.Cert != "" || t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair: %s", err.Error())
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
@@ -0,0 +1,42 @@
+package amqp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConnectionConfigURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		conf ConnectionConfig
+		want []string
+	}{
+		{"uri as is", ConnectionConfig{URI: "amqp://u:p@rabbit:5672/", Host: "other"},
+			[]string{"amqp://u:p@rabbit:5672/"}},
+		{"default port", ConnectionConfig{User: "linkit", Pass: "p", Host: "rabbit"},
+			[]string{"amqp://linkit:p@rabbit:5672"}},
+		{"tls default port", ConnectionConfig{User: "linkit", Pass: "p", Host: "rabbit", TLS: TLSConfig{Enabled: true}},
+			[]string{"amqps://linkit:p@rabbit:5671"}},
+		{"tls own port", ConnectionConfig{User: "linkit", Pass: "p", Host: "rabbit", Port: "5673", TLS: TLSConfig{Enabled: true}},
+			[]string{"amqps://linkit:p@rabbit:5673"}},
+		{"vhost", ConnectionConfig{User: "linkit", Pass: "p", Host: "rabbit", Port: "5672", Vhost: "mt/prod"},
+			[]string{"amqp://linkit:p@rabbit:5672/mt%2Fprod"}},
+		{"cluster", ConnectionConfig{User: "linkit", Pass: "p", Hosts: []string{"r1:5672", "r2:5672"}},
+			[]string{"amqp://linkit:p@r1:5672", "amqp://linkit:p@r2:5672"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conf.urls()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("urls %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (ConnectionConfig{Host: "rabbit", PassEnv: "RBMQ_TEST_UNSET_PASS"}).urls(); err == nil {
+		t.Fatal("unset pass_env accepted")
+	}
+}
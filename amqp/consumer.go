@@ -1,10 +1,11 @@
 package amqp
 
 import (
-	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -12,6 +13,7 @@ import (
 	amqp_driver "github.com/streadway/amqp"
 
 	"github.com/linkit360/go-utils/config"
+	"github.com/linkit360/go-utils/health"
 	"github.com/linkit360/go-utils/metrics"
 )
 
@@ -29,11 +31,28 @@ func InitConsumer(
 		log.Infof("rbmq consumer disabled: %s ", queueConf.Name)
 		return nil
 	}
+	if err := queueConf.Dedup.Validate(); err != nil {
+		log.WithFields(log.Fields{
+			"queue": queueConf.Name,
+			"error": err.Error(),
+		}).Fatal("rbmq consumer: dedup")
+	}
 
 	consumer := NewConsumer(consumerConf, queueConf.Name, queueConf.PrefetchCount)
 	if err := consumer.Connect(); err != nil {
 		log.Fatal("rbmq connect: ", err.Error())
 	}
+	consumer.SetAutoscale(queueConf.Autoscale)
+	if queueConf.Dedup.Enabled {
+		dedup, err := NewDedup(queueConf.Dedup, nil)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"queue": queueConf.Name,
+				"error": err.Error(),
+			}).Fatal("rbmq consumer: dedup")
+		}
+		consumer.SetDedup(dedup)
+	}
 
 	InitQueue(
 		consumer,
@@ -75,22 +94,86 @@ type ConsumerMetrics struct {
 	ReconnectCount     prometheus.Gauge
 	AnnounceQueueError prometheus.Gauge
 	QueueSize          prometheus.Gauge
+	Consumers          prometheus.Gauge
+	Workers            prometheus.Gauge
+	// labelled by queue, shared by all consumers of the process
+	Delivered       prometheus.Counter
+	Acked           prometheus.Counter
+	Nacked          prometheus.Counter
+	Requeued        prometheus.Counter
+	Rejected        prometheus.Counter
+	InFlight        prometheus.Gauge
+	HandlerDuration prometheus.Observer
+	Duplicates      prometheus.Counter
+	DedupErrors     prometheus.Counter
+}
+
+type consumerVecs struct {
+	delivered       *prometheus.CounterVec
+	acked           *prometheus.CounterVec
+	nacked          *prometheus.CounterVec
+	requeued        *prometheus.CounterVec
+	rejected        *prometheus.CounterVec
+	inFlight        *prometheus.GaugeVec
+	handlerDuration *prometheus.HistogramVec
+	duplicates      *prometheus.CounterVec
+	dedupErrors     *prometheus.CounterVec
 }
 
-func newGaugeConsumer(name, help string) prometheus.Gauge {
-	return metrics.PrometheusGauge("rbmq", "consumer", name, "rbmq consumer "+help)
+func newCounterConsumer(r *metrics.Registry, name, help string) *prometheus.CounterVec {
+	return r.PrometheusCounterVec("rbmq", "consumer", name, "rbmq consumer "+help, []string{"queue"})
 }
 
-func initConsumerMetrics(prefix string) ConsumerMetrics {
+func initConsumerVecs(r *metrics.Registry) consumerVecs {
+	return consumerVecs{
+		delivered: newCounterConsumer(r, "delivered_total", "messages delivered to workers"),
+		acked:     newCounterConsumer(r, "acked_total", "messages acked"),
+		nacked:    newCounterConsumer(r, "nacked_total", "messages nacked"),
+		requeued:  newCounterConsumer(r, "requeued_total", "messages nacked or rejected with requeue"),
+		rejected:  newCounterConsumer(r, "rejected_total", "messages rejected"),
+		inFlight: r.PrometheusGaugeVec("rbmq", "consumer", "in_flight",
+			"rbmq consumer messages being handled", []string{"queue"}),
+		handlerDuration: r.PrometheusHistogramVec("rbmq", "consumer", "handler_duration_seconds",
+			"rbmq consumer time from delivery to ack", metrics.LatencyBuckets, []string{"queue"}),
+		duplicates:  newCounterConsumer(r, "duplicates_total", "duplicate messages acked without handling"),
+		dedupErrors: newCounterConsumer(r, "dedup_errors_total", "dedup store errors"),
+	}
+}
+
+func newGaugeConsumer(r *metrics.Registry, name, help string) prometheus.Gauge {
+	return r.PrometheusGauge("rbmq", "consumer", name, "rbmq consumer "+help)
+}
+
+// initConsumerMetrics reuses connection metrics of the shared connection,
+// the consumers of the same queue share the metrics
+func initConsumerMetrics(r *metrics.Registry, prefix string, conn *ConnectionMetrics) ConsumerMetrics {
 	if prefix == "" {
 		log.Fatal("metrics prefix required")
 	}
-	return ConsumerMetrics{
-		Connected:          newGaugeConsumer(prefix+"_connected", "connected"),
-		ReconnectCount:     newGaugeConsumer(prefix+"_reconnect_count", "reconnect count"),
-		AnnounceQueueError: newGaugeConsumer(prefix+"_announce_errors", "announce errors"),
-		QueueSize:          newGaugeConsumer(prefix+"_queue_size", prefix+" queue size"),
+	vecs := initConsumerVecs(r)
+	m := ConsumerMetrics{
+		AnnounceQueueError: newGaugeConsumer(r, prefix+"_announce_errors", "announce errors"),
+		QueueSize:          newGaugeConsumer(r, prefix+"_queue_size", prefix+" queue size"),
+		Consumers:          newGaugeConsumer(r, prefix+"_consumers", prefix+" queue consumers count"),
+		Workers:            newGaugeConsumer(r, prefix+"_workers", "live workers"),
+		Delivered:          vecs.delivered.WithLabelValues(prefix),
+		Acked:              vecs.acked.WithLabelValues(prefix),
+		Nacked:             vecs.nacked.WithLabelValues(prefix),
+		Requeued:           vecs.requeued.WithLabelValues(prefix),
+		Rejected:           vecs.rejected.WithLabelValues(prefix),
+		InFlight:           vecs.inFlight.WithLabelValues(prefix),
+		HandlerDuration:    vecs.handlerDuration.WithLabelValues(prefix),
+		Duplicates:         vecs.duplicates.WithLabelValues(prefix),
+		DedupErrors:        vecs.dedupErrors.WithLabelValues(prefix),
 	}
+	if conn != nil {
+		m.Connected = conn.Connected
+		m.ReconnectCount = conn.ReconnectCount
+	} else {
+		m.Connected = newGaugeConsumer(r, prefix+"_connected", "connected")
+		m.ReconnectCount = newGaugeConsumer(r, prefix+"_reconnect_count", "reconnect count")
+	}
+	return m
 }
 
 type ConsumerConfig struct {
@@ -99,80 +182,128 @@ type ConsumerConfig struct {
 	ExchangeType   string           `default:"" yaml:"exchange_type"`
 	Exchange       string           `default:"" yaml:"exchange"`
 	ReconnectDelay int              `default:"30" yaml:"reconnect_delay"`
+	PollInterval   int              `default:"60" yaml:"poll_interval"` // seconds between queue inspections
+	Tap            config.TapConfig `yaml:"tap"`                        // archive of the consumed messages
+	TapUploader    TapUploader      `yaml:"-"`                          // uploads the archive when tap.upload is enabled
 }
 
 type Consumer struct {
 	m                  ConsumerMetrics
 	queuePrefetchCount int
-	conn               *amqp_driver.Connection
-	channel            *amqp_driver.Channel
-	done               chan error
-	url                string
+	conn               *Connection
+	mu                 sync.Mutex // guards channel swapped on reconnect and prefetch
+	channel            Channel
 	exchange           string // exchange that we will bind to
 	exchangeType       string // topic, direct, etc...
 	bindingKey         string // routing key that we are using
 	reconnectDelay     int
+	autoscale          *config.AutoscaleConfig
+	dedup              *Dedup
+	tap                *Tap
+	tickers            []*metrics.Ticker              // queue size poll and autoscalers, stopped by Close
+	queueOptions       map[string]config.QueueOptions // queues of the consumer outside the topology
+	healthName         string                         // connected check, unregistered by Close
 }
 
+// NewConsumer dials its own connection
 func NewConsumer(conf ConsumerConfig, queueName string, prefetchCount int) *Consumer {
-	log.SetLevel(log.DebugLevel)
+	m := initConsumerMetrics(metrics.NewRegistry(conf.Conn.Registerer), queueName, nil)
+	conn := newConnection(conf.Conn, conf.ReconnectDelay, ConnectionMetrics{
+		Connected:      m.Connected,
+		ReconnectCount: m.ReconnectCount,
+	})
+	return newConsumer(conn, conf, queueName, prefetchCount, m)
+}
+
+// NewConsumerWithConnection opens the consumer channel on the shared connection
+func NewConsumerWithConnection(conn *Connection, conf ConsumerConfig, queueName string, prefetchCount int) *Consumer {
+	return newConsumer(conn, conf, queueName, prefetchCount, initConsumerMetrics(conn.reg, queueName, &conn.m))
+}
 
-	url := fmt.Sprintf("amqp://%s:%s@%s:%s",
-		conf.Conn.User,
-		conf.Conn.Pass,
-		conf.Conn.Host,
-		conf.Conn.Port)
+// consumerSeq numbers the health checks of the consumers of the service,
+// several consumers may read the same queue
+var consumerSeq int64
+
+func newConsumer(conn *Connection, conf ConsumerConfig, queueName string, prefetchCount int, m ConsumerMetrics) *Consumer {
+	log.SetLevel(log.DebugLevel)
 
 	c := &Consumer{
-		m:                  initConsumerMetrics(queueName),
+		m:                  m,
 		queuePrefetchCount: prefetchCount,
-		conn:               nil,
+		conn:               conn,
 		channel:            nil,
-		done:               make(chan error),
-		url:                url,
 		exchange:           conf.Exchange,
 		exchangeType:       conf.ExchangeType,
 		bindingKey:         conf.BindingKey,
 		reconnectDelay:     conf.ReconnectDelay,
 	}
-	go func() {
-		for range time.Tick(time.Minute) {
-			queueSize, err := c.GetQueueSize(queueName)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err.Error(),
-				}).Error("cannot get queue size")
-			} else {
-				c.m.QueueSize.Set(float64(queueSize))
-			}
+	if conf.Tap.Enabled {
+		tap, err := newConfiguredTap(conf.Tap, conf.TapUploader, conn.reg.Registerer())
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("rbmq consumer: tap")
 		}
-	}()
+		c.SetTap(tap)
+	}
+	c.healthName = fmt.Sprintf("amqp_consumer_%s_%d", queueName, atomic.AddInt64(&consumerSeq, 1))
+	health.Register(c.healthName, true, health.ConnectedFunc(conn.Connected))
+	pollInterval := time.Duration(conf.PollInterval) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = time.Minute
+	}
+	c.every(pollInterval, func() {
+		queueInfo, err := c.inspect(queueName)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("cannot get queue size")
+		} else {
+			c.m.QueueSize.Set(float64(queueInfo.Messages))
+			c.m.Consumers.Set(float64(queueInfo.Consumers))
+		}
+	})
 	return c
 }
 
-func (c *Consumer) ReConnect(queueName, bindingKey string) (<-chan amqp_driver.Delivery, error) {
+// every runs fn in the background until Close
+func (c *Consumer) every(interval time.Duration, fn func()) {
+	t := metrics.Every(interval, fn)
+	c.mu.Lock()
+	c.tickers = append(c.tickers, t)
+	c.mu.Unlock()
+}
 
-	for true {
-		time.Sleep(time.Duration(c.reconnectDelay) * time.Second)
-		if err := c.Connect(); err != nil {
-			c.m.Connected.Set(0)
-			c.m.ReconnectCount.Inc()
+// Close stops the background loops of the consumer and removes its health check,
+// the channel and deliveries are left as is
+func (c *Consumer) Close() {
+	c.mu.Lock()
+	tickers := c.tickers
+	c.tickers = nil
+	c.mu.Unlock()
+	// the running calls may take the lock
+	for _, t := range tickers {
+		t.Stop()
+	}
+	health.Unregister(c.healthName)
+}
 
+// ReConnect waits for the connection, re-opens the channel and announces the queue again
+func (c *Consumer) ReConnect(queueName, bindingKey string) (<-chan amqp_driver.Delivery, error) {
+	for {
+		<-c.conn.Ready()
+		if err := c.Connect(); err != nil {
 			log.WithFields(log.Fields{
 				"error":          err.Error(),
 				"reconnectDelay": c.reconnectDelay,
 			}).Error("consumer reconnect error")
+			time.Sleep(time.Duration(c.reconnectDelay) * time.Second)
 		} else {
 			log.WithFields(log.Fields{
-				"url": c.url,
+				"queue": queueName,
 			}).Info("consumer connected")
 			break
 		}
 	}
 
-	c.m.Connected.Set(1)
-	c.m.ReconnectCount.Set(0)
-
 	deliveries, err := c.AnnounceQueue(queueName, bindingKey)
 	if err != nil {
 		c.m.AnnounceQueueError.Inc()
@@ -191,6 +322,10 @@ func (c *Consumer) ReConnect(queueName, bindingKey string) (<-chan amqp_driver.D
 // become unreachable unless put int a goroutine.
 // The q and rk params allow you to have multiple queue listeners in main
 // without them you would be tied into only using one queue per connection
+//
+// exactly threads handlers are started once, they read from the pool channel,
+// when the delivery channel is closed (channel or connection lost)
+// the consumer reconnects and the pool is fed from the new delivery channel
 func (c *Consumer) Handle(
 	deliveryChan <-chan amqp_driver.Delivery,
 	fn func(<-chan amqp_driver.Delivery),
@@ -198,66 +333,122 @@ func (c *Consumer) Handle(
 	queue string,
 	routingKey string,
 ) {
+	pool := newWorkerPool(fn, c.m)
+	pool.dedup = c.dedup
+	pool.tap = c.tap
+	pool.queue = queue
+	pool.start(threads)
+	if c.autoscale != nil {
+		c.runAutoscaler(pool, queue)
+	}
 
-	var err error
+	forward := pool.forward
+	if c.isPriorityQueue(queue) {
+		forward = pool.forwardByPriority
+	}
 
 	for {
-		for i := 0; i < threads; i++ {
-			go fn(deliveryChan)
+		if deliveryChan != nil {
+			forward(deliveryChan)
+			log.WithField("queue", queue).Error("rbmq consumer: deliveries closed")
 		}
+		deliveryChan = c.resubscribe(queue, routingKey)
+	}
+}
 
-		// Go into reconnect loop when
-		// c.done is passed non nil values
-		if <-c.done != nil {
-			deliveryChan, err = c.ReConnect(queue, routingKey)
-			if err != nil {
-				// Very likely chance of failing
-				// should not cause worker to terminate
-				log.WithField("error", err.Error()).Error("rbmq consumer reconnect failed")
-			} else {
-				log.Info("rbmq consumer: reconnected")
-			}
-		} else {
-			if err := c.conn.Close(); err != nil {
-				log.WithField("error", err.Error()).Error("rbmq consumer closing connection")
-			} else {
-				log.Error("rbmq consumer connection closed")
-			}
+// isPriorityQueue reports the topology declares the queue with max priority
+func (c *Consumer) isPriorityQueue(queue string) bool {
+	topology := c.conn.Topology()
+	if topology == nil {
+		return false
+	}
+	q, ok := topology.Get(queue)
+	return ok && q.Options.MaxPriority > 0
+}
+
+// resubscribe retries until the queue is announced again,
+// so the pool never waits on a nil delivery channel
+func (c *Consumer) resubscribe(queue, routingKey string) <-chan amqp_driver.Delivery {
+	for {
+		deliveryChan, err := c.ReConnect(queue, routingKey)
+		if err == nil {
+			log.WithField("queue", queue).Info("rbmq consumer: reconnected")
+			return deliveryChan
 		}
+		log.WithFields(log.Fields{
+			"queue":          queue,
+			"error":          err.Error(),
+			"reconnectDelay": c.reconnectDelay,
+		}).Error("rbmq consumer reconnect failed")
+		time.Sleep(time.Duration(c.reconnectDelay) * time.Second)
 	}
 }
 
-// Connect to RabbitMQ server
+// Connect opens the consumer channel
 func (c *Consumer) Connect() error {
-	var err error
-	c.conn, err = amqp_driver.Dial(c.url)
-	if err != nil {
-		return fmt.Errorf("amqp_driver.Dial: %s", err)
-	}
-	go func() {
-		// Waits here for the channel to be closed
-		log.Info("rbmq consumer closing: ", <-c.conn.NotifyClose(make(chan *amqp_driver.Error)))
-		// Let Handle know it's not time to reconnect
-		c.done <- errors.New("Channel Closed")
-	}()
-	c.channel, err = c.conn.Channel()
+	ch, err := c.conn.Channel()
 	if err != nil {
-		return fmt.Errorf("Channel: %s", err)
+		return err
 	}
-	c.m.Connected.Set(1)
+	c.mu.Lock()
+	c.channel = ch
+	c.mu.Unlock()
+	go func(ch Channel) {
+		// Waits here for the channel to be closed,
+		// Handle notices it by the closed delivery channel.
+		// the connected gauge is set by the connection
+		log.Info("rbmq consumer closing: ", <-ch.NotifyClose(make(chan *amqp_driver.Error, 1)))
+	}(ch)
 	return nil
 }
 
+func (c *Consumer) currentChannel() Channel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channel
+}
+
+// DeclareTopology declares the queues now and after every reconnect,
+// after that the consumer refuses to announce queues out of the topology
+func (c *Consumer) DeclareTopology(t config.Topology) error {
+	return c.conn.DeclareTopology(t)
+}
+
+// SetQueueOptions declares the queue with the options on every announce,
+// the queue does not need to be in the topology, for example, the exclusive reply queue
+func (c *Consumer) SetQueueOptions(queueName string, opts config.QueueOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queueOptions == nil {
+		c.queueOptions = make(map[string]config.QueueOptions)
+	}
+	c.queueOptions[queueName] = opts
+}
+
 // AnnounceQueue sets the queue that will be listened to for this connection
 func (c *Consumer) AnnounceQueue(queueName, bindingKey string) (<-chan amqp_driver.Delivery, error) {
-	queue, err := c.channel.QueueDeclare(
-		queueName, // name of the queue
-		false,     // durable
-		false,     // delete when usused
-		false,     // exclusive
-		false,     // noWait
-		nil,       // arguments
-	)
+	c.mu.Lock()
+	opts, own := c.queueOptions[queueName]
+	c.mu.Unlock()
+	topology := c.conn.Topology()
+	if !own && topology != nil && !topology.Has(queueName) {
+		log.WithFields(log.Fields{
+			"queue":   queueName,
+			"bindKey": bindingKey,
+		}).Error("rbmq consumer: queue not in topology")
+		return nil, fmt.Errorf("Queue %s not found in topology", queueName)
+	}
+
+	c.mu.Lock()
+	ch, prefetch := c.channel, c.queuePrefetchCount
+	c.mu.Unlock()
+	var queue amqp_driver.Queue
+	var err error
+	if own {
+		queue, err = queueDeclareWith(ch, queueName, opts)
+	} else {
+		queue, err = queueDeclare(ch, queueName, topology)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"queue":   queueName,
@@ -273,7 +464,9 @@ func (c *Consumer) AnnounceQueue(queueName, bindingKey string) (<-chan amqp_driv
 	// I would reccomend upping the about of Threads and Processors the go process
 	// uses before changing this although you will eventually need to reach some
 	// balance between threads, procs, and Qos.
-	err = c.channel.Qos(c.queuePrefetchCount, 0, false)
+	// With autoscale the qos is global for the channel: rabbit applies
+	// the channel limit to the running consumer when the autoscaler changes it.
+	err = ch.Qos(prefetch, 0, c.autoscale != nil)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"queue":   queueName,
@@ -300,7 +493,7 @@ func (c *Consumer) AnnounceQueue(queueName, bindingKey string) (<-chan amqp_driv
 	//	return nil, fmt.Errorf("Queue Bind: %s", err)
 	//}
 
-	deliveries, err := c.channel.Consume(
+	deliveries, err := ch.Consume(
 		queue.Name, // name
 		"",         // consumerTag,
 		false,      // noAck
@@ -321,14 +514,26 @@ func (c *Consumer) AnnounceQueue(queueName, bindingKey string) (<-chan amqp_driv
 }
 
 func (c *Consumer) GetQueueSize(queue string) (int, error) {
-	queueInfo, err := c.channel.QueueInspect(queue)
+	queueInfo, err := c.inspect(queue)
+	if err != nil {
+		return 0, err
+	}
+	return queueInfo.Messages, nil
+}
+
+func (c *Consumer) inspect(queue string) (amqp_driver.Queue, error) {
+	ch := c.currentChannel()
+	if ch == nil {
+		return amqp_driver.Queue{}, amqp_driver.ErrClosed
+	}
+	queueInfo, err := ch.QueueInspect(queue)
 	if err != nil {
 		err = fmt.Errorf("channel.QueueInspect: %s", err.Error())
 		log.WithFields(log.Fields{
 			"queue": queue,
 			"error": err.Error(),
 		}).Error("rbmq consumer: cannot inspect queue")
-		return 0, err
+		return queueInfo, err
 	}
-	return queueInfo.Messages, nil
+	return queueInfo, nil
 }
@@ -0,0 +1,264 @@
+package amqp
+
+// deduplication of the consumed messages: the key of the acked message is remembered for ttl,
+// the redelivered message with the same key is acked without calling the handler.
+// the key is marked on ack, so the nacked or rejected message is handled again.
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+	"github.com/linkit360/go-utils/metrics"
+)
+
+// DedupStore remembers the handled keys
+type DedupStore interface {
+	Seen(key string) (bool, error)
+	Mark(key string, ttl time.Duration) error
+}
+
+// DedupKeyFunc returns the key of the delivery, the delivery with empty key is not deduplicated
+type DedupKeyFunc func(d amqp_driver.Delivery) string
+
+// MessageIdKey uses the message id set by the notifier
+func MessageIdKey(d amqp_driver.Delivery) string {
+	return d.MessageId
+}
+
+// EventDataKey uses the field of the event data of EventNotify body, for example, tid
+func EventDataKey(field string) DedupKeyFunc {
+	return func(d amqp_driver.Delivery) string {
+		var e struct {
+			EventData map[string]interface{} `json:"event_data"`
+		}
+		if err := Decode(d, &e); err != nil {
+			return ""
+		}
+		v, ok := e.EventData[field]
+		if !ok || v == nil {
+			return ""
+		}
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+type Dedup struct {
+	Key   DedupKeyFunc
+	Store DedupStore
+	TTL   time.Duration
+}
+
+// NewDedup builds the dedup of the config with the given store,
+// the store is created by the config if nil, postgres store requires it
+func NewDedup(conf config.DedupConfig, store DedupStore) (*Dedup, error) {
+	d := &Dedup{
+		Key:   MessageIdKey,
+		Store: store,
+		TTL:   time.Duration(conf.TTL) * time.Second,
+	}
+	if conf.Key != "" && conf.Key != "message_id" {
+		d.Key = EventDataKey(conf.Key)
+	}
+	if d.Store == nil {
+		if conf.Store != "" && conf.Store != "memory" {
+			return nil, fmt.Errorf("dedup store %s: pass the store", conf.Store)
+		}
+		d.Store = NewMemoryDedupStore(conf.CacheSize)
+	}
+	return d, nil
+}
+
+// NewPostgresDedup keeps the keys in the table of the config
+func NewPostgresDedup(conf config.DedupConfig, db *sql.DB) (*Dedup, error) {
+	return NewDedup(conf, NewPostgresDedupStore(db, conf.Table, conf.CacheSize))
+}
+
+// SetDedup must be called before Handle
+func (c *Consumer) SetDedup(d *Dedup) {
+	c.dedup = d
+}
+
+// duplicate acks the delivery already handled
+func (p *workerPool) duplicate(d amqp_driver.Delivery) (key string, dup bool) {
+	if p.dedup == nil {
+		return "", false
+	}
+	key = p.dedup.Key(d)
+	if key == "" {
+		return "", false
+	}
+	seen, err := p.dedup.Store.Seen(key)
+	if err != nil {
+		p.m.DedupErrors.Inc()
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("rbmq consumer: dedup check")
+		return key, false
+	}
+	if !seen {
+		return key, false
+	}
+
+	p.m.Duplicates.Inc()
+	err = d.Ack(false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("rbmq consumer: ack duplicate")
+	}
+	if p.tap != nil {
+		p.tap.consumed(p.queue, d, time.Now(), TapOutcomeDuplicate, err)
+	}
+	return key, true
+}
+
+// mark is called on ack of the handler
+func (p *workerPool) mark(key string) {
+	if err := p.dedup.Store.Mark(key, p.dedup.TTL); err != nil {
+		p.m.DedupErrors.Inc()
+		log.WithFields(log.Fields{
+			"key":   key,
+			"error": err.Error(),
+		}).Error("rbmq consumer: dedup mark")
+	}
+}
+
+// MemoryDedupStore keeps the last size keys
+type MemoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // front is the latest
+	keys  map[string]*list.Element
+}
+
+type memoryDedupKey struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	if size <= 0 {
+		size = 100000
+	}
+	return &MemoryDedupStore{
+		size:  size,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryDedupStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[key]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(e.Value.(memoryDedupKey).expires) {
+		s.order.Remove(e)
+		delete(s.keys, key)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := memoryDedupKey{key: key, expires: time.Now().Add(ttl)}
+	if e, ok := s.keys[key]; ok {
+		e.Value = v
+		s.order.MoveToFront(e)
+		return nil
+	}
+	s.keys[key] = s.order.PushFront(v)
+	for s.order.Len() > s.size {
+		last := s.order.Back()
+		s.order.Remove(last)
+		delete(s.keys, last.Value.(memoryDedupKey).key)
+	}
+	return nil
+}
+
+// PostgresDedupStore keeps the keys in the table shared by all instances of the service,
+// the seen keys are cached in memory.
+//
+//	CREATE TABLE xmp_consumed_messages (
+//	    key VARCHAR(255) PRIMARY KEY,
+//	    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+//	);
+//	CREATE INDEX xmp_consumed_messages_expires_at_idx ON xmp_consumed_messages(expires_at);
+type PostgresDedupStore struct {
+	db    *sql.DB
+	table string
+	cache *MemoryDedupStore
+	clean *metrics.Ticker
+}
+
+// NewPostgresDedupStore removes the expired keys once an hour until Close
+func NewPostgresDedupStore(db *sql.DB, table string, cacheSize int) *PostgresDedupStore {
+	s := &PostgresDedupStore{
+		db:    db,
+		table: table,
+		cache: NewMemoryDedupStore(cacheSize),
+	}
+	s.clean = metrics.Every(time.Hour, func() {
+		if err := s.Cleanup(); err != nil {
+			log.WithFields(log.Fields{
+				"table": table,
+				"error": err.Error(),
+			}).Error("rbmq consumer: dedup cleanup")
+		}
+	})
+	return s
+}
+
+// Close stops the cleanup of the expired keys
+func (s *PostgresDedupStore) Close() {
+	s.clean.Stop()
+}
+
+func (s *PostgresDedupStore) Seen(key string) (bool, error) {
+	if seen, _ := s.cache.Seen(key); seen {
+		return true, nil
+	}
+	query := fmt.Sprintf("SELECT expires_at FROM %s WHERE key = $1 AND expires_at > now()", s.table)
+	var expiresAt time.Time
+	err := s.db.QueryRow(query, key).Scan(&expiresAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("db.QueryRow: %s, query: %s", err.Error(), query)
+	}
+	s.cache.Mark(key, time.Until(expiresAt))
+	return true, nil
+}
+
+func (s *PostgresDedupStore) Mark(key string, ttl time.Duration) error {
+	query := fmt.Sprintf("INSERT INTO %s (key, expires_at) VALUES ($1, $2) "+
+		"ON CONFLICT (key) DO UPDATE SET expires_at = EXCLUDED.expires_at", s.table)
+	if _, err := s.db.Exec(query, key, time.Now().Add(ttl)); err != nil {
+		return fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	}
+	s.cache.Mark(key, ttl)
+	return nil
+}
+
+// Cleanup removes the expired keys
+func (s *PostgresDedupStore) Cleanup() error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE expires_at < now()", s.table)
+	if _, err := s.db.Exec(query); err != nil {
+		return fmt.Errorf("db.Exec: %s, query: %s", err.Error(), query)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package amqp
+
+import (
+	"testing"
+	"time"
+
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+	s := NewMemoryDedupStore(2)
+	seen := func(key string) bool {
+		t.Helper()
+		ok, err := s.Seen(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if seen("a") {
+		t.Fatal("a is seen before mark")
+	}
+	s.Mark("a", time.Hour)
+	s.Mark("b", time.Hour)
+	if !seen("a") || !seen("b") {
+		t.Fatal("marked keys are not seen")
+	}
+
+	// a is marked again, so b is the least recent one
+	s.Mark("a", time.Hour)
+	s.Mark("c", time.Hour)
+	if seen("b") {
+		t.Fatal("b is not evicted")
+	}
+	if !seen("a") || !seen("c") {
+		t.Fatal("recent keys are evicted")
+	}
+
+	s.Mark("expired", -time.Second)
+	if seen("expired") {
+		t.Fatal("expired key is seen")
+	}
+}
+
+func TestDedupKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		d    amqp_driver.Delivery
+		want string
+	}{
+		{"message id", "message_id", amqp_driver.Delivery{MessageId: "m1"}, "m1"},
+		{"default is message id", "", amqp_driver.Delivery{MessageId: "m1"}, "m1"},
+		{"event data field", "tid",
+			amqp_driver.Delivery{Body: []byte(`{"event_name":"e","event_data":{"tid":"t1"}}`)}, "t1"},
+		{"numeric field", "id",
+			amqp_driver.Delivery{Body: []byte(`{"event_data":{"id":42}}`)}, "42"},
+		{"missing field", "tid",
+			amqp_driver.Delivery{Body: []byte(`{"event_data":{"msisdn":"7999"}}`)}, ""},
+		{"not json", "tid", amqp_driver.Delivery{Body: []byte("x")}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDedup(config.DedupConfig{Key: tt.key, TTL: 60}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := d.Key(tt.d); got != tt.want {
+				t.Fatalf("key %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupConfig(t *testing.T) {
+	tests := []struct {
+		conf  config.DedupConfig
+		valid bool
+	}{
+		{config.DedupConfig{}, true},
+		{config.DedupConfig{Enabled: true, Store: "memory"}, true},
+		{config.DedupConfig{Enabled: true}, true},
+		{config.DedupConfig{Enabled: true, Store: "postgres"}, false},
+		{config.DedupConfig{Enabled: true, Store: "redis"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.conf.Validate(); (err == nil) != tt.valid {
+			t.Fatalf("%+v: Validate() = %v, valid %v", tt.conf, err, tt.valid)
+		}
+	}
+	if _, err := NewDedup(config.DedupConfig{Enabled: true, Store: "postgres"}, nil); err == nil {
+		t.Fatal("postgres dedup without the store")
+	}
+}
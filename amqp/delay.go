@@ -0,0 +1,186 @@
+package amqp
+
+// delayed publishing: the message waits in the per-delay queue with the message ttl
+// and is dead-lettered to the target queue when the ttl expires.
+// when the delayed message exchange plugin is enabled and configured,
+// the message is published to the exchange with the x-delay header instead.
+// the delay is counted from the moment the message is published to rabbit,
+// so the message is never delivered earlier than requested.
+// the delays are rounded up to the buckets for the delay queues,
+// so the count of the delay queues is bounded.
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+const (
+	// the delay queue is removed by rabbit when it was not declared for its ttl and this margin
+	delayQueueExpiresMargin = 10 * time.Minute
+	// the delay queue is declared again after it, so it never expires while in use
+	delayQueueRefresh = time.Minute
+)
+
+// DefaultDelayBuckets are the delay queue ttls in seconds,
+// the delays longer than the last one are rounded up to its multiple
+var DefaultDelayBuckets = []int{1, 5, 10, 30, 60, 300, 600, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600}
+
+// PublishAt publishes the message to be delivered not earlier than at
+func (n *Notifier) PublishAt(msg AMQPMessage, at time.Time) {
+	msg.NotBefore = at
+	n.Publish(msg)
+}
+
+// PublishAfter publishes the message to be delivered not earlier than after the delay
+func (n *Notifier) PublishAfter(msg AMQPMessage, delay time.Duration) {
+	n.PublishAt(msg, time.Now().Add(delay))
+}
+
+// delayOf returns the time left till NotBefore, rounded up to the granularity
+func (n *Notifier) delayOf(msg AMQPMessage) time.Duration {
+	if msg.NotBefore.IsZero() {
+		return 0
+	}
+	delay := time.Until(msg.NotBefore)
+	if delay <= 0 {
+		return 0
+	}
+	granularity := time.Duration(n.conf.DelayGranularity) * time.Second
+	if granularity <= 0 {
+		granularity = time.Second
+	}
+	if rest := delay % granularity; rest != 0 {
+		delay += granularity - rest
+	}
+	return delay
+}
+
+func (n *Notifier) delayedExchangeEnabled() bool {
+	return n.conf.DelayedExchange != "" && atomic.LoadInt32(&n.delayedExchangeOff) == 0
+}
+
+// checkDelayBuckets refuses the buckets which are not positive and ascending
+func checkDelayBuckets(buckets []int) error {
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return fmt.Errorf("delay_buckets %v: positive ascending seconds required", buckets)
+		}
+	}
+	return nil
+}
+
+// delayBucket rounds the delay up to the bucket of the delay queue
+func delayBucket(delay time.Duration, buckets []int) time.Duration {
+	if len(buckets) == 0 {
+		buckets = DefaultDelayBuckets
+	}
+	for _, b := range buckets {
+		if bucket := time.Duration(b) * time.Second; delay <= bucket {
+			return bucket
+		}
+	}
+	last := time.Duration(buckets[len(buckets)-1]) * time.Second
+	if rest := delay % last; rest != 0 {
+		delay += last - rest
+	}
+	return delay
+}
+
+func delayQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s_delay_%d", queue, int64(delay/time.Second))
+}
+
+// delayedRoute returns the exchange and the routing key to publish the delayed message with
+func (p *publisher) delayedRoute(msg AMQPMessage, delay time.Duration, publishing *amqp_driver.Publishing) (exchange, key string, err error) {
+	n := p.n
+	if n.delayedExchangeEnabled() {
+		exchange = n.conf.DelayedExchange
+		if err = p.declareDelayedExchange(msg.QueueName); err != nil {
+			return
+		}
+		if publishing.Headers == nil {
+			publishing.Headers = amqp_driver.Table{}
+		}
+		publishing.Headers["x-delay"] = int64(delay / time.Millisecond)
+		return exchange, msg.QueueName, nil
+	}
+
+	delay = delayBucket(delay, n.conf.DelayBuckets)
+	key = delayQueueName(msg.QueueName, delay)
+	err = p.declareDelayQueue(key, msg.QueueName, delay)
+	return "", key, err
+}
+
+// declareDelayQueue declares the queue with the message ttl
+// dead-lettering to the target queue
+func (p *publisher) declareDelayQueue(name, target string, delay time.Duration) error {
+	conn := p.n.conn
+	var opts config.QueueOptions
+	if topology := conn.Topology(); topology != nil {
+		if q, ok := topology.Get(target); ok {
+			opts = q.Options
+		}
+	}
+	ttl := int64(delay / time.Millisecond)
+	expires := int64((delay + delayQueueExpiresMargin) / time.Millisecond)
+
+	if err := conn.declareQueue(p.channel, target); err != nil {
+		return err
+	}
+	return conn.declareFresh(name, delayQueueRefresh, func() error {
+		_, err := p.channel.QueueDeclare(
+			name,         // name
+			opts.Durable, // durable
+			false,        // delete when unused
+			false,        // exclusive
+			false,        // no-wait
+			amqp_driver.Table{
+				"x-message-ttl":             ttl,
+				"x-expires":                 expires,
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": target,
+			},
+		)
+		return err
+	})
+}
+
+// declareDelayedExchange declares the x-delayed-message exchange
+// and binds the target queue to it by the queue name
+func (p *publisher) declareDelayedExchange(target string) error {
+	conn := p.n.conn
+	exchange := p.n.conf.DelayedExchange
+	err := conn.declareFresh("exchange:"+exchange, 0, func() error {
+		return p.channel.ExchangeDeclare(
+			exchange,            // name
+			"x-delayed-message", // type
+			true,                // durable
+			false,               // auto-deleted
+			false,               // internal
+			false,               // no-wait
+			amqp_driver.Table{"x-delayed-type": "direct"},
+		)
+	})
+	if err != nil {
+		// the plugin is not enabled, the channel is closed by rabbit
+		// and the message is requeued to go to the delay queue
+		atomic.StoreInt32(&p.n.delayedExchangeOff, 1)
+		log.WithFields(log.Fields{
+			"exchange": exchange,
+			"error":    err.Error(),
+		}).Error("rbmq notifier: delayed exchange unavailable, fall back to delay queues")
+		return err
+	}
+	if err := conn.declareQueue(p.channel, target); err != nil {
+		return err
+	}
+	return conn.declareFresh("bind:"+exchange+":"+target, 0, func() error {
+		return p.channel.QueueBind(target, target, exchange, false, nil)
+	})
+}
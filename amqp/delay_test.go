@@ -0,0 +1,97 @@
+package amqp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelayBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		buckets []int
+		want    time.Duration
+	}{
+		{"zero", 0, nil, time.Second},
+		{"below the first", 500 * time.Millisecond, nil, time.Second},
+		{"the first", time.Second, nil, time.Second},
+		{"between", 1500 * time.Millisecond, nil, 5 * time.Second},
+		{"exact", 30 * time.Second, nil, 30 * time.Second},
+		{"up to the minute", 45 * time.Second, nil, time.Minute},
+		{"the last", 24 * time.Hour, nil, 24 * time.Hour},
+		{"multiple of the last", 25 * time.Hour, nil, 48 * time.Hour},
+		{"exact multiple of the last", 48 * time.Hour, nil, 48 * time.Hour},
+		{"own buckets", 3 * time.Second, []int{2, 4}, 4 * time.Second},
+		{"own buckets multiple", 5 * time.Second, []int{2, 4}, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := delayBucket(tt.delay, tt.buckets); got != tt.want {
+				t.Fatalf("delayBucket(%s, %v) = %s, want %s", tt.delay, tt.buckets, got, tt.want)
+			}
+		})
+	}
+}
+
+// the default ladder is ascending, so every delay queue holds one ttl
+func TestDefaultDelayBuckets(t *testing.T) {
+	if err := checkDelayBuckets(DefaultDelayBuckets); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range DefaultDelayBuckets {
+		bucket := time.Duration(b) * time.Second
+		if got := delayBucket(bucket, nil); got != bucket {
+			t.Fatalf("bucket %s is rounded to %s", bucket, got)
+		}
+		if got, want := delayQueueName("q", bucket), fmt.Sprintf("q_delay_%d", b); got != want {
+			t.Fatalf("delay queue name %s, want %s", got, want)
+		}
+	}
+}
+
+func TestCheckDelayBuckets(t *testing.T) {
+	tests := []struct {
+		buckets []int
+		valid   bool
+	}{
+		{nil, true},
+		{[]int{1, 5, 10}, true},
+		{[]int{0, 5}, false},
+		{[]int{-1}, false},
+		{[]int{5, 5}, false},
+		{[]int{10, 5}, false},
+	}
+	for _, tt := range tests {
+		if err := checkDelayBuckets(tt.buckets); (err == nil) != tt.valid {
+			t.Fatalf("checkDelayBuckets(%v) = %v, valid %v", tt.buckets, err, tt.valid)
+		}
+	}
+}
+
+func TestDelayOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		granularity int
+		notBefore   time.Duration // from now, 0 - not set
+		want        time.Duration
+	}{
+		{"not delayed", 1, 0, 0},
+		{"in the past", 1, -time.Minute, 0},
+		{"rounded up to the second", 0, 1500 * time.Millisecond, 2 * time.Second},
+		{"rounded up to the granularity", 5, 7 * time.Second, 10 * time.Second},
+		{"exact granularity", 5, 10 * time.Second, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &Notifier{conf: NotifierConfig{DelayGranularity: tt.granularity}}
+			var msg AMQPMessage
+			if tt.notBefore != 0 {
+				msg.NotBefore = time.Now().Add(tt.notBefore)
+			}
+			if got := n.delayOf(msg); got != tt.want {
+				t.Fatalf("delayOf = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package amqp
+
+// the seam between the package and the amqp driver,
+// the notifier and the consumer use only these methods,
+// so they run against the in-memory broker of amqptest package in tests
+
+import (
+	amqp_driver "github.com/streadway/amqp"
+)
+
+// Channel is the subset of *amqp_driver.Channel the package uses
+type Channel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp_driver.Table) (amqp_driver.Queue, error)
+	QueueInspect(name string) (amqp_driver.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp_driver.Table) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp_driver.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp_driver.Publishing) error
+	Get(queue string, autoAck bool) (amqp_driver.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp_driver.Table) (<-chan amqp_driver.Delivery, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp_driver.Confirmation) chan amqp_driver.Confirmation
+	NotifyClose(c chan *amqp_driver.Error) chan *amqp_driver.Error
+	Close() error
+}
+
+// Conn is the subset of *amqp_driver.Connection the package uses
+type Conn interface {
+	Channel() (Channel, error)
+	NotifyClose(c chan *amqp_driver.Error) chan *amqp_driver.Error
+	Close() error
+}
+
+// Dialer opens the connection to the url
+type Dialer func(url string, conf amqp_driver.Config) (Conn, error)
+
+type driverConn struct {
+	*amqp_driver.Connection
+}
+
+func (c driverConn) Channel() (Channel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// DialDriver dials rabbit with the amqp driver
+func DialDriver(url string, conf amqp_driver.Config) (Conn, error) {
+	conn, err := amqp_driver.DialConfig(url, conf)
+	if err != nil {
+		return nil, err
+	}
+	return driverConn{conn}, nil
+}
@@ -2,61 +2,127 @@ package amqp
 
 // this package for holding connection to rabbit.
 // it has 2 channels, reading and pending
+// pending messages are published by conf.PublishChannels publishers in parallel
 // it reconnects is the connection has lost
 // metrics avialable, do not forget to add handler for /var/debug
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nu7hatch/gouuid"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	amqp_driver "github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/linkit360/go-utils/config"
+	"github.com/linkit360/go-utils/health"
 	m "github.com/linkit360/go-utils/metrics"
 )
 
 type Notifier struct {
-	url            string
+	// messages buffered and not published yet, first for the 64-bit atomic alignment
+	unpublished    int64
 	conf           NotifierConfig
 	reconnectDelay int
-	stop           bool
-	done           chan error
-	conn           *amqp_driver.Connection
-	channel        *amqp_driver.Channel
+	closed         chan struct{} // stops the publishers, closed by Close
+	closeOnce      sync.Once
+	publishers     sync.WaitGroup
+	conn           *Connection
+	channel        Channel
 	m              NotifierMetrics
 	publishCh      chan AMQPMessage
 	pendingCh      chan AMQPMessage
-	FinishCh       chan bool
-}
-type ConnectionConfig struct {
-	User string `yaml:"user" default:"linkit"`
-	Pass string `yaml:"pass" default:"dg-U_oHhy7-"`
-	Host string `yaml:"host" default:"localhost"`
-	Port string `yaml:"port" default:"5672"`
+	outbox         Outbox
+	outboxTicker   *m.Ticker // drains the outbox
+	bufferTicker   *m.Ticker // sets the reading buffer gauge
+	healthName     string    // connected check, unregistered by Close
+	codec          Codec
+	tap            *Tap
+	// set when the delayed exchange could not be declared
+	delayedExchangeOff int32
+	FinishCh           chan bool
 }
 
 type NotifierConfig struct {
-	Conn           ConnectionConfig `yaml:"conn"`
-	ReconnectDelay int              `default:"10" yaml:"reconnect_delay"`
-	ChanCapacity   int64            `default:"1000" yaml:"chan_capacity"`
+	Conn            ConnectionConfig `yaml:"conn"`
+	ReconnectDelay  int              `default:"10" yaml:"reconnect_delay"`
+	ChanCapacity    int64            `default:"1000" yaml:"chan_capacity"`
+	PublishChannels int              `default:"1" yaml:"publish_channels"`    // channels publishing in parallel
+	OverflowPolicy  string           `default:"block" yaml:"overflow_policy"` // block, drop_oldest, drop_newest, outbox
+	OutboxPath      string           `default:"" yaml:"outbox_path"`          // json lines file for outbox policy
+	// x-delayed-message exchange name, delay queues with ttl are used if empty
+	DelayedExchange  string `default:"" yaml:"delayed_exchange"`
+	DelayGranularity int    `default:"1" yaml:"delay_granularity"` // seconds, delays are rounded up to it
+	// seconds, ascending, the delay queue ttls, DefaultDelayBuckets if empty
+	DelayBuckets []int `yaml:"delay_buckets"`
+	// codec of the encoded events, text/plain json by default
+	ContentType       string            `default:"text/plain" yaml:"content_type"`
+	QueueContentTypes map[string]string `yaml:"queue_content_types"` // per queue content type
+	Tap               config.TapConfig  `yaml:"tap"`                 // archive of the published messages
+	TapUploader       TapUploader       `yaml:"-"`                   // uploads the archive when tap.upload is enabled
 }
 
+// NewNotifier dials its own connection
 func NewNotifier(c NotifierConfig) *Notifier {
-	connectionUrl := fmt.Sprintf("amqp://%s:%s@%s:%s", c.Conn.User, c.Conn.Pass, c.Conn.Host, c.Conn.Port)
+	metrics := initNotifierMetrics(m.NewRegistry(c.Conn.Registerer))
+	conn := newConnection(c.Conn, c.ReconnectDelay, ConnectionMetrics{
+		Connected:      metrics.Connected,
+		ReconnectCount: metrics.ReconnectCount,
+	})
+	return newNotifier(conn, c, metrics)
+}
+
+// NewNotifierWithConnection opens the notifier channel on the shared connection,
+// the notifier reports the connected status of the shared connection
+func NewNotifierWithConnection(conn *Connection, c NotifierConfig) *Notifier {
+	metrics := initNotifierMetrics(conn.reg)
+	metrics.Connected = conn.m.Connected
+	metrics.ReconnectCount = conn.m.ReconnectCount
+	return newNotifier(conn, c, metrics)
+}
+
+// notifierSeq numbers the health checks of the notifiers of the service
+var notifierSeq int64
+
+func newNotifier(conn *Connection, c NotifierConfig, metrics NotifierMetrics) *Notifier {
+	if err := checkOverflowPolicy(c.OverflowPolicy); err != nil {
+		log.WithField("error", err.Error()).Fatal("rbmq notifier config")
+	}
+	if err := checkDelayBuckets(c.DelayBuckets); err != nil {
+		log.WithField("error", err.Error()).Fatal("rbmq notifier config")
+	}
 	notifier := &Notifier{
-		url:            connectionUrl,
 		conf:           c,
 		reconnectDelay: c.ReconnectDelay,
-		done:           make(chan error),
-		conn:           nil,
+		conn:           conn,
 		channel:        nil,
-		m:              initNotifierMetrics(),
+		m:              metrics,
 		publishCh:      make(chan AMQPMessage, c.ChanCapacity),
 		pendingCh:      make(chan AMQPMessage, c.ChanCapacity),
+		closed:         make(chan struct{}),
 	}
 
+	if c.OutboxPath != "" {
+		notifier.SetOutbox(NewFileOutbox(c.OutboxPath))
+	}
+	if c.Tap.Enabled {
+		tap, err := newConfiguredTap(c.Tap, c.TapUploader, conn.reg.Registerer())
+		if err != nil {
+			log.WithField("error", err.Error()).Fatal("rbmq notifier: tap")
+		}
+		notifier.SetTap(tap)
+	}
+	notifier.healthName = fmt.Sprintf("amqp_notifier_%d", atomic.AddInt64(&notifierSeq, 1))
+	health.Register(notifier.healthName, true, health.ConnectedFunc(conn.Connected))
+
+	notifier.bufferTicker = m.Every(time.Second, func() {
+		notifier.m.ReadingBuffer.Set(float64(len(notifier.publishCh)))
+	})
 	go notifier.publisher()
 	if err := notifier.connect(); err != nil {
 		log.Error("Connect error ", err.Error())
@@ -65,11 +131,40 @@ func NewNotifier(c NotifierConfig) *Notifier {
 	return notifier
 }
 
+// Publish follows the overflow policy, by default it blocks until the buffer has room
 func (n *Notifier) Publish(msg AMQPMessage) {
 	if msg.QueueName == "" {
 		log.WithField("event", msg.EventName).Fatal("empty queue name")
 	}
-	n.publishCh <- msg
+	if err := n.PublishContext(context.Background(), msg); err != nil {
+		log.WithFields(log.Fields{
+			"q":     msg.QueueName,
+			"e":     msg.EventName,
+			"error": err.Error(),
+		}).Error("rbmq notifier: publish")
+	}
+}
+
+// PublishBatch puts the messages to the publish buffer,
+// the publish channels send them in parallel.
+// It returns when all messages are buffered or ctx is done
+func (n *Notifier) PublishBatch(ctx context.Context, msgs []AMQPMessage) error {
+	for i, msg := range msgs {
+		if msg.QueueName == "" {
+			return fmt.Errorf("message %d, event %s: empty queue name", i, msg.EventName)
+		}
+	}
+	for i, msg := range msgs {
+		msg.buffered()
+		msg.startSpan(ctx)
+		if err := n.buffer(ctx, msg); err != nil {
+			msg.endSpan(TapOutcomeDropped, err)
+			err = fmt.Errorf("buffered %d of %d: %s", i, len(msgs), err.Error())
+			log.WithField("error", err.Error()).Error("rbmq notifier publish batch")
+			return err
+		}
+	}
+	return nil
 }
 
 type Buffer struct {
@@ -77,6 +172,36 @@ type Buffer struct {
 	Pending chan AMQPMessage `json:"pending"`
 }
 
+// Buffered returns the count of messages in the notifier buffers and being published,
+// zero means every buffered message is sent to rabbit
+func (n *Notifier) Buffered() int {
+	return int(atomic.LoadInt64(&n.unpublished))
+}
+
+// tryBuffer puts the message to the publish buffer if it has room
+func (n *Notifier) tryBuffer(msg AMQPMessage) bool {
+	atomic.AddInt64(&n.unpublished, 1)
+	select {
+	case n.publishCh <- msg:
+		return true
+	default:
+		atomic.AddInt64(&n.unpublished, -1)
+		return false
+	}
+}
+
+// buffer waits for the room in the publish buffer until ctx is done
+func (n *Notifier) buffer(ctx context.Context, msg AMQPMessage) error {
+	atomic.AddInt64(&n.unpublished, 1)
+	select {
+	case n.publishCh <- msg:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&n.unpublished, -1)
+		return ctx.Err()
+	}
+}
+
 func (n *Notifier) GetQueueSize(queue string) (int, error) {
 getQueueSize:
 	queueInfo, err := n.channel.QueueInspect(queue)
@@ -98,43 +223,52 @@ getQueueSize:
 
 func (n *Notifier) connect() error {
 	var err error
-	n.conn, err = amqp_driver.Dial(n.url)
+	n.channel, err = n.conn.Channel()
 	if err != nil {
-		return fmt.Errorf("amqp_driver.Dial: %s", err)
+		return err
 	}
 
-	go func() {
-		log.Info("rbmq notifier closing: ", <-n.conn.NotifyClose(make(chan *amqp_driver.Error)))
-		n.done <- errors.New("Channel Closed")
-	}()
+	// the connected gauge is set by the connection
+	go func(ch Channel) {
+		log.Info("rbmq notifier closing: ", <-ch.NotifyClose(make(chan *amqp_driver.Error, 1)))
+	}(n.channel)
 
-	n.channel, err = n.conn.Channel()
-	if err != nil {
-		return fmt.Errorf("Channel: %s", err)
-	}
-	n.m.Connected.Set(1)
 	log.Info("rbmq notifier: connected")
 	return nil
 }
 
-func (n *Notifier) reConnect() {
+// DeclareTopology declares the queues now and after every reconnect,
+// published messages use the topology declare options
+func (n *Notifier) DeclareTopology(t config.Topology) error {
+	return n.conn.DeclareTopology(t)
+}
 
-	for {
-		log.WithField("reconnectDelay", n.reconnectDelay).Info("rbmq notifier reconnects...")
-		time.Sleep(time.Duration(n.reconnectDelay) * time.Second)
+// Close stops the background loops and the publishers of the notifier and removes its health check,
+// it waits for the messages being published, the buffered messages are not published
+func (n *Notifier) Close() {
+	n.closeOnce.Do(func() {
+		close(n.closed)
+	})
+	n.publishers.Wait()
+	n.stopOutbox()
+	n.bufferTicker.Stop()
+	health.Unregister(n.healthName)
+}
 
+// reConnect waits for the connection and re-opens the channel used to inspect queues
+func (n *Notifier) reConnect() {
+	for {
+		<-n.conn.Ready()
 		if err := n.connect(); err != nil {
-			n.m.Connected.Set(0)
-			n.m.ReconnectCount.Inc()
-			log.WithField("error", err.Error()).Error("rbmq notifier could not reconnect")
-
+			log.WithFields(log.Fields{
+				"error":          err.Error(),
+				"reconnectDelay": n.reconnectDelay,
+			}).Error("rbmq notifier could not reopen channel")
+			time.Sleep(time.Duration(n.reconnectDelay) * time.Second)
 		} else {
-			log.WithField("url", n.url).Info("rbmq notifier connected")
 			break
 		}
 	}
-	n.m.Connected.Set(1)
-	n.m.ReconnectCount.Set(0)
 }
 
 type EventNotify struct {
@@ -142,34 +276,51 @@ type EventNotify struct {
 	EventData interface{} `json:"event_data,omitempty"`
 }
 type AMQPMessage struct {
-	QueueName string
-	Priority  uint8
-	Body      []byte
-	EventName string
+	QueueName     string
+	Priority      uint8
+	Body          []byte
+	EventName     string
+	CorrelationId string
+	ReplyTo       string
+	ContentType   string    // text/plain if empty
+	MessageId     string    // generated when empty, consumers deduplicate by it
+	NotBefore     time.Time // delayed publishing, zero - publish at once
+	// amqp headers, PublishContext adds the trace context of ctx
+	Headers    map[string]interface{} `json:",omitempty"`
+	bufferedAt time.Time
+	span       trace.Span // ends when the message is published or dropped
 }
 
-func (n *Notifier) publisher() {
-	var running bool
-	go func() {
-		for range time.Tick(1 * time.Second) {
-			n.m.ReadingBuffer.Set(float64(len(n.publishCh)))
-		}
-	}()
+// buffered stamps the message when it gets to the publish buffer,
+// the message id stays the same on republish after errors
+func (msg *AMQPMessage) buffered() {
+	msg.bufferedAt = time.Now()
+	if msg.MessageId != "" {
+		return
+	}
+	if u4, err := uuid.NewV4(); err == nil {
+		msg.MessageId = u4.String()
+	}
+}
 
+func (n *Notifier) publisher() {
+	n.publishers.Add(1)
 	go func() {
+		defer n.publishers.Done()
 		for {
-			if n.stop {
+			var msg AMQPMessage
+			select {
+			case msg = <-n.publishCh:
+			case <-n.closed:
 				return
 			}
 
-			var msg AMQPMessage
-			msg, running = <-n.publishCh
-			if !running {
-				log.WithField("rbmq", "!running").Info("rbmq notifier")
+			select {
+			case n.pendingCh <- msg:
+			case <-n.closed:
 				return
 			}
-
-			if n.pendingCh <- msg; len(n.pendingCh) > 0 {
+			if len(n.pendingCh) > 0 {
 				n.m.PendingBuffer.Set(float64(len(n.pendingCh)))
 				log.WithFields(log.Fields{
 					"q":            msg.QueueName,
@@ -179,92 +330,54 @@ func (n *Notifier) publisher() {
 		}
 	}()
 
-	for {
-		if n.stop {
-			return
-		}
-		var msg AMQPMessage
-		select {
-		case <-n.done:
-			n.reConnect()
-			log.Info("rbmq notifier: reconnected")
-
-		case msg = <-n.pendingCh:
-			if n.stop {
-				break
-			}
-			q, err := n.channel.QueueDeclare(
-				msg.QueueName, // name
-				false,         // durable
-				false,         // delete when unused
-				false,         // exclusive
-				false,         // no-wait
-				nil,           // arguments
-			)
-
-			if err != nil {
-				n.m.PublishErrs.Inc()
-				n.conn.Close()
-
-				n.pendingCh <- msg
-				err = fmt.Errorf("%s Channel.QueueDeclare: %s", msg.QueueName, err.Error())
-				log.WithField("error", err.Error()).Error("rbmq notifier queue declare failed")
-				break
-			}
-
-			err = n.channel.Publish(
-				"",     // exchange
-				q.Name, // routing key
-				false,  // mandatory
-				false,  // immediate
-				amqp_driver.Publishing{
-					ContentType: "text/plain",
-					Body:        msg.Body,
-					Priority:    msg.Priority,
-				})
-
-			if err != nil {
-				n.m.PublishErrs.Inc()
-				n.conn.Close()
-
-				n.pendingCh <- msg
-				err = fmt.Errorf("%s Channel.Publish: %s", msg.QueueName, err.Error())
-				log.WithField("error", err.Error()).Error("rbmq notifier publish failed")
-				break
-			}
-			f := log.Fields{
-				"q":   q.Name,
-				"len": len(n.pendingCh),
-			}
-			if msg.EventName != "" {
-				f["e"] = msg.EventName
-			}
-			log.WithFields(f).Debug("rbmq: publish")
+	publishers := n.conf.PublishChannels
+	if publishers <= 0 {
+		publishers = 1
+	}
+	for i := 0; i < publishers; i++ {
+		p := &publisher{
+			id:   i,
+			n:    n,
+			done: make(chan error, 1),
 		}
+		n.publishers.Add(1)
+		go p.run()
 	}
-
 }
 
+// NotifierMetrics are shared by all notifiers of the process,
+// publish counters are labelled by queue and event name
 type NotifierMetrics struct {
-	SessionRequests m.Gauge
-	PublishErrs     m.Gauge
-	ReconnectCount  prometheus.Gauge
-	Connected       prometheus.Gauge
-	PendingBuffer   prometheus.Gauge
-	ReadingBuffer   prometheus.Gauge
+	Published      *prometheus.CounterVec
+	Failed         *prometheus.CounterVec
+	Requeued       *prometheus.CounterVec
+	Dropped        *prometheus.CounterVec
+	Spilled        *prometheus.CounterVec
+	Delayed        *prometheus.CounterVec
+	PublishLatency *prometheus.HistogramVec
+	ReconnectCount prometheus.Gauge
+	Connected      prometheus.Gauge
+	PendingBuffer  prometheus.Gauge
+	ReadingBuffer  prometheus.Gauge
 }
 
-func newGaugeNotifier(name, help string) m.Gauge {
-	return m.NewGauge("rbmq", "notifier", name, "rbmq "+help)
+func newCounterNotifier(r *m.Registry, name, help string, labels ...string) *prometheus.CounterVec {
+	return r.PrometheusCounterVec("rbmq", "notifier", name, "rbmq "+help, labels)
 }
-func initNotifierMetrics() NotifierMetrics {
-	metrics := NotifierMetrics{
-		SessionRequests: newGaugeNotifier("reconnects_count", "publisher reconnect count"),
-		PublishErrs:     newGaugeNotifier("errors", "publish errors"),
-		Connected:       m.PrometheusGauge("rbmq", "notifier", "connected", "publisher connection status"),
-		ReconnectCount:  m.PrometheusGauge("rbmq", "notifier", "reconnect_count", "publisher connection attempts count"),
-		PendingBuffer:   m.PrometheusGauge("rbmq", "notifier", "buffer_pending_gauge_size", "publisher pending buffer size"),
-		ReadingBuffer:   m.PrometheusGauge("rbmq", "notifier", "buffer_reading_gauge_size", "publisher reading buffer size"),
+
+// initNotifierMetrics reuses the registered metrics, so several notifiers do not panic
+func initNotifierMetrics(r *m.Registry) NotifierMetrics {
+	return NotifierMetrics{
+		Published:      newCounterNotifier(r, "published_total", "published messages", "queue", "event"),
+		Failed:         newCounterNotifier(r, "failed_total", "publish errors", "queue", "event"),
+		Requeued:       newCounterNotifier(r, "requeued_total", "messages put back to pending buffer after error", "queue", "event"),
+		Dropped:        newCounterNotifier(r, "dropped_total", "messages dropped on full buffer", "queue"),
+		Spilled:        newCounterNotifier(r, "spilled_total", "messages written to outbox on full buffer", "queue"),
+		Delayed:        newCounterNotifier(r, "delayed_total", "messages published with delay", "queue"),
+		PublishLatency: r.PrometheusHistogramVec("rbmq", "notifier", "publish_latency_seconds", "rbmq time from buffering to publish", m.LatencyBuckets, []string{"queue"}),
+		Connected:      r.PrometheusGauge("rbmq", "notifier", "connected", "publisher connection status"),
+		ReconnectCount: r.PrometheusGauge("rbmq", "notifier", "reconnect_count", "publisher connection attempts count"),
+		PendingBuffer:  r.PrometheusGauge("rbmq", "notifier", "buffer_pending_gauge_size", "publisher pending buffer size"),
+		ReadingBuffer:  r.PrometheusGauge("rbmq", "notifier", "buffer_reading_gauge_size", "publisher reading buffer size"),
 	}
-	return metrics
 }
@@ -0,0 +1,239 @@
+package amqp
+
+// what to do when the publish buffer is full
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/metrics"
+)
+
+const (
+	// wait for the room in the buffer until ctx is done
+	OverflowBlock = "block"
+	// drop the oldest buffered message to make room for the new one
+	OverflowDropOldest = "drop_oldest"
+	// drop the new message
+	OverflowDropNewest = "drop_newest"
+	// write the new message to the outbox, it is published later
+	OverflowOutbox = "outbox"
+)
+
+var ErrPublishDropped = errors.New("publish buffer is full, message dropped")
+
+// checkOverflowPolicy refuses the unknown policy, empty is block
+func checkOverflowPolicy(policy string) error {
+	switch policy {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowOutbox:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow_policy %q, use %s, %s, %s or %s",
+		policy, OverflowBlock, OverflowDropOldest, OverflowDropNewest, OverflowOutbox)
+}
+
+// Outbox keeps the messages which didn't fit into the publish buffer
+type Outbox interface {
+	Put(msg AMQPMessage) error
+	// Take returns the kept messages, they are kept until Commit,
+	// so Take returns them again after a crash
+	Take() ([]AMQPMessage, error)
+	// Commit forgets the messages returned by Take
+	Commit() error
+}
+
+// PublishContext puts the message to the publish buffer
+// and follows the overflow policy when the buffer is full
+func (n *Notifier) PublishContext(ctx context.Context, msg AMQPMessage) error {
+	if msg.QueueName == "" {
+		return fmt.Errorf("event %s: empty queue name", msg.EventName)
+	}
+	msg.buffered()
+	msg.startSpan(ctx)
+
+	if n.tryBuffer(msg) {
+		return nil
+	}
+
+	switch n.conf.OverflowPolicy {
+	case OverflowDropNewest:
+		n.m.Dropped.WithLabelValues(msg.QueueName).Inc()
+		n.finish(msg, TapOutcomeDropped, ErrPublishDropped)
+		return ErrPublishDropped
+
+	case OverflowDropOldest:
+		atomic.AddInt64(&n.unpublished, 1)
+		for {
+			select {
+			case n.publishCh <- msg:
+				return nil
+			case old := <-n.publishCh:
+				atomic.AddInt64(&n.unpublished, -1)
+				n.m.Dropped.WithLabelValues(old.QueueName).Inc()
+				n.finish(old, TapOutcomeDropped, ErrPublishDropped)
+				log.WithFields(log.Fields{
+					"q": old.QueueName,
+					"e": old.EventName,
+				}).Warn("rbmq notifier: buffer full, oldest dropped")
+			case <-ctx.Done():
+				atomic.AddInt64(&n.unpublished, -1)
+				n.m.Dropped.WithLabelValues(msg.QueueName).Inc()
+				n.finish(msg, TapOutcomeDropped, ctx.Err())
+				return ctx.Err()
+			}
+		}
+
+	case OverflowOutbox:
+		if n.outbox == nil {
+			err := fmt.Errorf("outbox is not set: %s", ErrPublishDropped.Error())
+			n.m.Dropped.WithLabelValues(msg.QueueName).Inc()
+			n.finish(msg, TapOutcomeDropped, err)
+			return err
+		}
+		if err := n.outbox.Put(msg); err != nil {
+			err = fmt.Errorf("outbox.Put: %s", err.Error())
+			n.m.Dropped.WithLabelValues(msg.QueueName).Inc()
+			n.finish(msg, TapOutcomeDropped, err)
+			return err
+		}
+		n.m.Spilled.WithLabelValues(msg.QueueName).Inc()
+		// the trace context stays in the headers of the spilled message
+		n.finish(msg, TapOutcomeSpilled, nil)
+		return nil
+
+	default:
+		if err := n.buffer(ctx, msg); err != nil {
+			n.m.Dropped.WithLabelValues(msg.QueueName).Inc()
+			n.finish(msg, TapOutcomeDropped, err)
+			return err
+		}
+		return nil
+	}
+}
+
+// SetOutbox sets the outbox for OverflowOutbox policy
+// and starts publishing its messages back when the buffer is empty,
+// the drain loop of the previous outbox is stopped
+func (n *Notifier) SetOutbox(o Outbox) {
+	n.stopOutbox()
+	n.outbox = o
+	n.outboxTicker = metrics.Every(time.Second, func() {
+		n.drainOutbox(o)
+	})
+}
+
+func (n *Notifier) stopOutbox() {
+	if n.outboxTicker != nil {
+		n.outboxTicker.Stop()
+		n.outboxTicker = nil
+	}
+}
+
+// drainOutbox forgets the outbox messages only when they are buffered
+func (n *Notifier) drainOutbox(o Outbox) {
+	if len(n.publishCh) > 0 {
+		return
+	}
+	msgs, err := o.Take()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("rbmq notifier: cannot take from outbox")
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	log.WithField("count", len(msgs)).Info("rbmq notifier: publish from outbox")
+	for _, msg := range msgs {
+		n.buffer(context.Background(), msg)
+	}
+	if err = o.Commit(); err != nil {
+		log.WithField("error", err.Error()).Error("rbmq notifier: cannot commit outbox")
+	}
+}
+
+// FileOutbox keeps the messages in the json lines file,
+// Take renames it to path.taking, Commit removes it
+type FileOutbox struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileOutbox(path string) *FileOutbox {
+	return &FileOutbox{path: path}
+}
+
+func (o *FileOutbox) Put(msg AMQPMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("file.Write: %s", err.Error())
+	}
+	return nil
+}
+
+func (o *FileOutbox) taking() string {
+	return o.path + ".taking"
+}
+
+// Take returns the messages not committed after the previous Take first
+func (o *FileOutbox) Take() (msgs []AMQPMessage, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, err = os.Stat(o.taking()); os.IsNotExist(err) {
+		if err = os.Rename(o.path, o.taking()); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("os.Rename: %s", err.Error())
+		}
+	}
+
+	f, err := os.Open(o.taking())
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg AMQPMessage
+		if err = json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %s", err.Error())
+		}
+		msgs = append(msgs, msg)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %s", err.Error())
+	}
+	return msgs, nil
+}
+
+func (o *FileOutbox) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := os.Remove(o.taking()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("os.Remove: %s", err.Error())
+	}
+	return nil
+}
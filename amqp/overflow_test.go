@@ -0,0 +1,122 @@
+package amqp
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/linkit360/go-utils/metrics"
+)
+
+// the notifier with the full buffer of one message and without publishers
+func fullNotifier(t *testing.T, policy string, outbox Outbox) *Notifier {
+	n := &Notifier{
+		conf:      NotifierConfig{OverflowPolicy: policy},
+		m:         initNotifierMetrics(metrics.NewRegistry(prometheus.NewRegistry())),
+		publishCh: make(chan AMQPMessage, 1),
+		outbox:    outbox,
+	}
+	if !n.tryBuffer(AMQPMessage{QueueName: "q", Body: []byte("old")}) {
+		t.Fatal("empty buffer has no room")
+	}
+	return n
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		outbox   bool
+		err      bool
+		buffered string // the message left in the buffer
+		spilled  bool
+	}{
+		{OverflowDropNewest, false, true, "old", false},
+		{OverflowDropOldest, false, false, "new", false},
+		{OverflowOutbox, true, false, "old", true},
+		{OverflowOutbox, false, true, "old", false},
+		{OverflowBlock, false, true, "old", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var outbox *FileOutbox
+			var o Outbox
+			if tt.outbox {
+				outbox = NewFileOutbox(filepath.Join(t.TempDir(), "outbox"))
+				o = outbox
+			}
+			n := fullNotifier(t, tt.policy, o)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := n.PublishContext(ctx, AMQPMessage{QueueName: "q", Body: []byte("new")})
+			if (err != nil) != tt.err {
+				t.Fatalf("PublishContext error %v, want error %v", err, tt.err)
+			}
+			if n.Buffered() != 1 {
+				t.Fatalf("buffered %d, want 1", n.Buffered())
+			}
+			if got := string((<-n.publishCh).Body); got != tt.buffered {
+				t.Fatalf("buffer has %s, want %s", got, tt.buffered)
+			}
+			if outbox == nil {
+				return
+			}
+			msgs, err := outbox.Take()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spilled := len(msgs) == 1 && string(msgs[0].Body) == "new"; spilled != tt.spilled {
+				t.Fatalf("outbox has %d messages, spilled %v", len(msgs), tt.spilled)
+			}
+		})
+	}
+	if err := checkOverflowPolicy("spill"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+// the taken messages are returned again until Commit
+func TestFileOutbox(t *testing.T) {
+	o := NewFileOutbox(filepath.Join(t.TempDir(), "outbox"))
+	take := func(want ...string) {
+		t.Helper()
+		msgs, err := o.Take()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != len(want) {
+			t.Fatalf("took %d messages, want %d", len(msgs), len(want))
+		}
+		for i, msg := range msgs {
+			if string(msg.Body) != want[i] {
+				t.Fatalf("message %d is %s, want %s", i, msg.Body, want[i])
+			}
+		}
+	}
+	commit := func() {
+		t.Helper()
+		if err := o.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(body string) {
+		t.Helper()
+		if err := o.Put(AMQPMessage{QueueName: "q", Body: []byte(body)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	take()
+	put("1")
+	put("2")
+	take("1", "2")
+	put("3")
+	take("1", "2")
+	commit()
+	take("3")
+	commit()
+	take()
+}
@@ -0,0 +1,179 @@
+package amqp
+
+// the worker pool keeps the handlers reading from stable channels,
+// so the supervisor may swap the delivery source after reconnect
+// without starting new handlers.
+// every handler has own channel, so the pool can stop a single handler when it shrinks.
+// the dispatcher is the only sender to the handler channels: it queues the deliveries
+// and hands the next one only to a handler ready to take it,
+// so no delivery waits in front of a handler out of the priority order
+
+import (
+	"container/heap"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+)
+
+type workerPool struct {
+	fn      func(<-chan amqp_driver.Delivery)
+	in      chan prioritized // tracked deliveries of the current source
+	flush   chan struct{}    // the source is closed, the queued deliveries are released
+	m       ConsumerMetrics
+	stats   *handlerStats
+	dedup   *Dedup
+	tap     *Tap
+	queue   string // archived with the consumed messages
+	mu      sync.Mutex
+	workers []chan amqp_driver.Delivery // channel of every handler
+	retired []chan amqp_driver.Delivery // closed by the dispatcher
+	changed chan struct{}               // closed when the workers change
+}
+
+func newWorkerPool(fn func(<-chan amqp_driver.Delivery), m ConsumerMetrics) *workerPool {
+	return &workerPool{
+		fn:      fn,
+		in:      make(chan prioritized),
+		flush:   make(chan struct{}),
+		m:       m,
+		stats:   &handlerStats{},
+		changed: make(chan struct{}),
+	}
+}
+
+// start runs the dispatcher and the fixed number of handlers, it is called once
+func (p *workerPool) start(threads int) {
+	go p.dispatch()
+	p.resize(threads)
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// resize starts or stops handlers, the stopped handler finishes
+// the delivery it already has and its channel is closed
+func (p *workerPool) resize(threads int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.workers) < threads {
+		p.workers = append(p.workers, p.add())
+	}
+	for len(p.workers) > threads {
+		last := len(p.workers) - 1
+		p.retired = append(p.retired, p.workers[last])
+		p.workers = p.workers[:last]
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *workerPool) add() chan amqp_driver.Delivery {
+	ch := make(chan amqp_driver.Delivery)
+
+	p.m.Workers.Inc()
+	go func() {
+		defer p.m.Workers.Dec()
+		p.fn(ch)
+		log.WithFields(log.Fields{
+			"fn": runtime.FuncForPC(reflect.ValueOf(p.fn).Pointer()).Name(),
+		}).Debug("rbmq consumer: worker exited")
+	}()
+	return ch
+}
+
+// dispatch hands the first queued delivery to the first handler waiting for it
+func (p *workerPool) dispatch() {
+	pending := &deliveryHeap{}
+	var seq uint64
+	for {
+		p.mu.Lock()
+		workers, retired, changed := p.workers, p.retired, p.changed
+		p.retired = nil
+		p.mu.Unlock()
+		for _, ch := range retired {
+			close(ch)
+		}
+
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(p.in)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(p.flush)},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(changed)},
+		}
+		if pending.Len() > 0 {
+			next := reflect.ValueOf((*pending)[0].d)
+			for _, ch := range workers {
+				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: next})
+			}
+		}
+
+		chosen, received, _ := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			seq++
+			d := received.Interface().(prioritized)
+			d.seq = seq
+			heap.Push(pending, d)
+		case 1:
+			for _, left := range *pending {
+				left.tracker.release()
+			}
+			*pending = (*pending)[:0]
+		case 2:
+			// the workers are taken again
+		default:
+			next := heap.Pop(pending).(prioritized)
+			next.tracker.start()
+		}
+	}
+}
+
+// forward feeds the handlers in the order of arrival until the source is closed,
+// acks of the handlers are counted by the tracking acknowledger
+func (p *workerPool) forward(source <-chan amqp_driver.Delivery) {
+	p.feed(source, false)
+}
+
+// feed queues the deliveries to the dispatcher,
+// the deliveries of the closed source no handler took are requeued by rabbit
+func (p *workerPool) feed(source <-chan amqp_driver.Delivery, byPriority bool) {
+	for d := range source {
+		key, dup := p.duplicate(d)
+		if dup {
+			continue
+		}
+		tracker := p.track(&d, key)
+		next := prioritized{d: d, tracker: tracker}
+		if byPriority {
+			next.priority = d.Priority
+		}
+		p.in <- next
+	}
+	p.flush <- struct{}{}
+}
+
+// track counts the delivery and wraps its acknowledger,
+// the dedup key is marked on ack, the outcome is archived by the tap
+// and ends the consumer span
+func (p *workerPool) track(d *amqp_driver.Delivery, key string) *trackingAcknowledger {
+	p.m.Delivered.Inc()
+	tracker := newTrackingAcknowledger(d.Acknowledger, p.m, p.stats)
+	tracker.span = p.consumeSpan(d)
+	if key != "" {
+		tracker.onAck = func() { p.mark(key) }
+	}
+	if p.tap != nil {
+		delivery, receivedAt := *d, time.Now()
+		tracker.onDone = func(outcome string, err error) {
+			p.tap.consumed(p.queue, delivery, receivedAt, outcome, err)
+		}
+	}
+	d.Acknowledger = tracker
+	return tracker
+}
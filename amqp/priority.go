@@ -0,0 +1,66 @@
+package amqp
+
+// priority queues: rabbit sorts only the messages it has not sent yet,
+// the prefetched ones are sorted by the consumer before the handlers get them
+
+import (
+	amqp_driver "github.com/streadway/amqp"
+)
+
+// business priorities, the higher is handled first
+const (
+	PriorityRetry       uint8 = 1
+	PriorityPeriodic    uint8 = 3
+	PriorityFirstCharge uint8 = 5
+	PrioritySMS         uint8 = 8
+	// declare priority queues with it as max_priority
+	MaxPriority uint8 = 10
+)
+
+// Priorities maps the business flow to the message priority,
+// it may be changed on service start
+var Priorities = map[string]uint8{
+	"retry":        PriorityRetry,
+	"periodic":     PriorityPeriodic,
+	"first_charge": PriorityFirstCharge,
+	"sms":          PrioritySMS,
+}
+
+// PriorityFor returns the priority of the flow, unknown flows get 0
+func PriorityFor(flow string) uint8 {
+	return Priorities[flow]
+}
+
+type prioritized struct {
+	d        amqp_driver.Delivery
+	tracker  *trackingAcknowledger
+	priority uint8 // 0 for the queues without priority
+	seq      uint64
+}
+
+// deliveryHeap pops the highest priority first, fifo within the priority
+type deliveryHeap []prioritized
+
+func (h deliveryHeap) Len() int { return len(h) }
+func (h deliveryHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h deliveryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deliveryHeap) Push(x interface{}) { *h = append(*h, x.(prioritized)) }
+func (h *deliveryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// forwardByPriority feeds the handlers with the highest priority delivery
+// among the prefetched ones until the source is closed.
+// The not handled deliveries of the closed source are requeued by rabbit.
+func (p *workerPool) forwardByPriority(source <-chan amqp_driver.Delivery) {
+	p.feed(source, true)
+}
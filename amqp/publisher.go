@@ -0,0 +1,176 @@
+package amqp
+
+// publisher owns one channel of the notifier and publishes the pending messages,
+// the notifier runs several of them so publishing is not latency bound
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+)
+
+type publisher struct {
+	id      int
+	n       *Notifier
+	channel Channel
+	done    chan error
+}
+
+func (p *publisher) connect() error {
+	var err error
+	p.channel, err = p.n.conn.Channel()
+	if err != nil {
+		return err
+	}
+	go func(ch Channel) {
+		log.WithField("publisher", p.id).Info("rbmq notifier closing: ", <-ch.NotifyClose(make(chan *amqp_driver.Error, 1)))
+		p.done <- errors.New("Channel Closed")
+	}(p.channel)
+	return nil
+}
+
+// reConnect returns false when the notifier is closed
+func (p *publisher) reConnect() bool {
+	for {
+		select {
+		case <-p.n.conn.Ready():
+		case <-p.n.closed:
+			return false
+		}
+		if err := p.connect(); err != nil {
+			log.WithFields(log.Fields{
+				"publisher":      p.id,
+				"error":          err.Error(),
+				"reconnectDelay": p.n.reconnectDelay,
+			}).Error("rbmq notifier could not reopen channel")
+			select {
+			case <-time.After(time.Duration(p.n.reconnectDelay) * time.Second):
+			case <-p.n.closed:
+				return false
+			}
+		} else {
+			return true
+		}
+	}
+}
+
+// run publishes until the notifier is closed
+func (p *publisher) run() {
+	defer p.n.publishers.Done()
+	if err := p.connect(); err != nil {
+		log.WithFields(log.Fields{
+			"publisher": p.id,
+			"error":     err.Error(),
+		}).Error("rbmq notifier connect error")
+		if !p.reConnect() {
+			return
+		}
+	}
+	defer func() {
+		p.channel.Close()
+	}()
+
+	for {
+		select {
+		case <-p.n.closed:
+			return
+
+		case <-p.done:
+			if !p.reConnect() {
+				return
+			}
+			log.WithField("publisher", p.id).Info("rbmq notifier: reconnected")
+
+		case msg := <-p.n.pendingCh:
+			p.publish(msg)
+		}
+	}
+}
+
+// requeue puts the failed message back unless the notifier is closed
+func (p *publisher) requeue(msg AMQPMessage) {
+	select {
+	case p.n.pendingCh <- msg:
+	case <-p.n.closed:
+	}
+}
+
+// publish declares the queue only once per connection,
+// the delayed message goes to the delay queue or the delayed exchange
+func (p *publisher) publish(msg AMQPMessage) {
+	n := p.n
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = ContentTypeText
+	}
+	publishing := amqp_driver.Publishing{
+		ContentType:   contentType,
+		Body:          msg.Body,
+		Priority:      msg.Priority,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		MessageId:     msg.MessageId,
+		Headers:       amqp_driver.Table(msg.Headers),
+	}
+	exchange, key := "", msg.QueueName
+
+	var err error
+	delay := n.delayOf(msg)
+	if delay > 0 {
+		exchange, key, err = p.delayedRoute(msg, delay, &publishing)
+	} else {
+		err = n.conn.declareQueue(p.channel, msg.QueueName)
+	}
+	if err != nil {
+		n.m.Failed.WithLabelValues(msg.QueueName, msg.EventName).Inc()
+		p.channel.Close()
+
+		n.m.Requeued.WithLabelValues(msg.QueueName, msg.EventName).Inc()
+		p.requeue(msg)
+		err = fmt.Errorf("%s Channel.QueueDeclare: %s", key, err.Error())
+		n.finish(msg, TapOutcomeFailed, err)
+		log.WithField("error", err.Error()).Error("rbmq notifier queue declare failed")
+		return
+	}
+
+	err = p.channel.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		publishing,
+	)
+
+	if err != nil {
+		n.m.Failed.WithLabelValues(msg.QueueName, msg.EventName).Inc()
+		p.channel.Close()
+
+		n.m.Requeued.WithLabelValues(msg.QueueName, msg.EventName).Inc()
+		p.requeue(msg)
+		err = fmt.Errorf("%s Channel.Publish: %s", msg.QueueName, err.Error())
+		n.finish(msg, TapOutcomeFailed, err)
+		log.WithField("error", err.Error()).Error("rbmq notifier publish failed")
+		return
+	}
+	if delay > 0 {
+		n.m.Delayed.WithLabelValues(msg.QueueName).Inc()
+	}
+	n.m.Published.WithLabelValues(msg.QueueName, msg.EventName).Inc()
+	atomic.AddInt64(&n.unpublished, -1)
+	n.finish(msg, TapOutcomePublished, nil)
+	if !msg.bufferedAt.IsZero() {
+		n.m.PublishLatency.WithLabelValues(msg.QueueName).Observe(time.Since(msg.bufferedAt).Seconds())
+	}
+	f := log.Fields{
+		"q":   msg.QueueName,
+		"len": len(n.pendingCh),
+	}
+	if msg.EventName != "" {
+		f["e"] = msg.EventName
+	}
+	log.WithFields(f).Debug("rbmq: publish")
+}
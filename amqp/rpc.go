@@ -0,0 +1,247 @@
+package amqp
+
+// request/response over the operator queues pair:
+// the request is published with CorrelationId and ReplyTo,
+// the reply is matched by CorrelationId in the reply queue of the instance:
+// <response_queue>.<uuid>, exclusive and deleted with the connection,
+// so the replies to the calls of the other instances never reach it
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+	"github.com/linkit360/go-utils/metrics"
+)
+
+type RPCConfig struct {
+	RequestQueue  string `yaml:"request_queue"`
+	ResponseQueue string `yaml:"response_queue"` // prefix of the reply queue of the instance
+	ThreadsCount  int    `yaml:"threads_count" default:"1"`
+	LateTTL       int    `yaml:"late_ttl" default:"600"` // seconds to remember timed out calls
+}
+
+// OperatorRPCConfig returns config for <operator>_requests/_responses
+// or for <operator>_sms_requests/_sms_responses pair
+func OperatorRPCConfig(operatorName string, sms bool) RPCConfig {
+	if sms {
+		return RPCConfig{
+			RequestQueue:  config.SMSRequestQueue(operatorName),
+			ResponseQueue: config.SMSResponsesQueue(operatorName),
+			ThreadsCount:  1,
+			LateTTL:       600,
+		}
+	}
+	return RPCConfig{
+		RequestQueue:  config.RequestQueue(operatorName),
+		ResponseQueue: config.ResponsesQueue(operatorName),
+		ThreadsCount:  1,
+		LateTTL:       600,
+	}
+}
+
+type RPCMetrics struct {
+	Calls     prometheus.Counter
+	Timeouts  prometheus.Counter
+	Late      prometheus.Counter
+	Unmatched prometheus.Counter
+	Pending   prometheus.Gauge
+}
+
+func newCounterRPC(r *metrics.Registry, name, help string) *prometheus.CounterVec {
+	return r.PrometheusCounterVec("rbmq", "rpc", name, "rbmq rpc "+help, []string{"queue"})
+}
+
+func initRPCMetrics(r *metrics.Registry, queue string) RPCMetrics {
+	return RPCMetrics{
+		Calls:     newCounterRPC(r, "calls_total", "calls count").WithLabelValues(queue),
+		Timeouts:  newCounterRPC(r, "timeouts_total", "calls timed out").WithLabelValues(queue),
+		Late:      newCounterRPC(r, "late_replies_total", "replies came after the call timed out").WithLabelValues(queue),
+		Unmatched: newCounterRPC(r, "unmatched_replies_total", "replies with unknown correlation id").WithLabelValues(queue),
+		Pending: r.PrometheusGaugeVec("rbmq", "rpc", "pending",
+			"rbmq rpc calls waiting for reply", []string{"queue"}).WithLabelValues(queue),
+	}
+}
+
+type RPCClient struct {
+	conf     RPCConfig
+	m        RPCMetrics
+	notifier *Notifier
+	consumer *Consumer
+	replyTo  string // reply queue of the instance
+	mu       sync.Mutex
+	pending  map[string]chan amqp_driver.Delivery
+	expired  map[string]time.Time
+	sweeper  *metrics.Ticker // forgets the expired calls
+}
+
+// NewRPCClient publishes requests with the notifier
+// and reads replies with the consumer, both keep their own connections
+func NewRPCClient(conf RPCConfig, n *Notifier, c *Consumer) (*RPCClient, error) {
+	if conf.RequestQueue == "" || conf.ResponseQueue == "" {
+		return nil, fmt.Errorf("request and response queues required")
+	}
+	if conf.ThreadsCount <= 0 {
+		conf.ThreadsCount = 1
+	}
+	r := &RPCClient{
+		conf:     conf,
+		m:        initRPCMetrics(n.conn.reg, conf.RequestQueue),
+		notifier: n,
+		consumer: c,
+		pending:  make(map[string]chan amqp_driver.Delivery),
+		expired:  make(map[string]time.Time),
+	}
+
+	u4, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("uuid.NewV4: %s", err.Error())
+	}
+	r.replyTo = conf.ResponseQueue + "." + u4.String()
+	c.SetQueueOptions(r.replyTo, config.QueueOptions{AutoDelete: true, Exclusive: true})
+	deliveries, err := c.AnnounceQueue(r.replyTo, r.replyTo)
+	if err != nil {
+		return nil, fmt.Errorf("AnnounceQueue: %s", err.Error())
+	}
+	go c.Handle(deliveries, r.handleReplies, conf.ThreadsCount, r.replyTo, r.replyTo)
+
+	r.sweeper = metrics.Every(time.Minute, r.cleanupExpired)
+	log.WithFields(log.Fields{
+		"requests":  conf.RequestQueue,
+		"responses": r.replyTo,
+	}).Info("rbmq rpc init done")
+	return r, nil
+}
+
+// Call publishes the request and waits for the reply until ctx is done
+// the reply is already acked when returned
+func (r *RPCClient) Call(ctx context.Context, msg AMQPMessage) (amqp_driver.Delivery, error) {
+	if msg.CorrelationId == "" {
+		u4, err := uuid.NewV4()
+		if err != nil {
+			return amqp_driver.Delivery{}, fmt.Errorf("uuid.NewV4: %s", err.Error())
+		}
+		msg.CorrelationId = u4.String()
+	}
+	msg.QueueName = r.conf.RequestQueue
+	msg.ReplyTo = r.replyTo
+
+	replyCh := make(chan amqp_driver.Delivery, 1)
+	r.mu.Lock()
+	r.pending[msg.CorrelationId] = replyCh
+	r.m.Pending.Set(float64(len(r.pending)))
+	r.mu.Unlock()
+
+	r.m.Calls.Inc()
+	begin := time.Now()
+	if err := r.notifier.PublishContext(ctx, msg); err != nil {
+		r.mu.Lock()
+		delete(r.pending, msg.CorrelationId)
+		r.m.Pending.Set(float64(len(r.pending)))
+		r.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"q":     r.conf.RequestQueue,
+			"id":    msg.CorrelationId,
+			"error": err.Error(),
+		}).Error("rbmq rpc: publish")
+		return amqp_driver.Delivery{}, fmt.Errorf("PublishContext: %s", err.Error())
+	}
+
+	select {
+	case d := <-replyCh:
+		log.WithFields(log.Fields{
+			"q":    r.conf.RequestQueue,
+			"id":   msg.CorrelationId,
+			"took": time.Since(begin),
+		}).Debug("rbmq rpc: reply")
+		return d, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		_, waiting := r.pending[msg.CorrelationId]
+		if waiting {
+			delete(r.pending, msg.CorrelationId)
+			r.expired[msg.CorrelationId] = time.Now()
+			r.m.Pending.Set(float64(len(r.pending)))
+		}
+		r.mu.Unlock()
+
+		r.m.Timeouts.Inc()
+		if !waiting {
+			// the reply came together with ctx done and is dropped
+			r.m.Late.Inc()
+		}
+		log.WithFields(log.Fields{
+			"q":     r.conf.RequestQueue,
+			"id":    msg.CorrelationId,
+			"took":  time.Since(begin),
+			"error": ctx.Err().Error(),
+		}).Error("rbmq rpc: no reply")
+		return amqp_driver.Delivery{}, ctx.Err()
+	}
+}
+
+func (r *RPCClient) handleReplies(deliveries <-chan amqp_driver.Delivery) {
+	for d := range deliveries {
+		r.mu.Lock()
+		replyCh, found := r.pending[d.CorrelationId]
+		if found {
+			delete(r.pending, d.CorrelationId)
+			r.m.Pending.Set(float64(len(r.pending)))
+		}
+		_, late := r.expired[d.CorrelationId]
+		if late {
+			delete(r.expired, d.CorrelationId)
+		}
+		r.mu.Unlock()
+
+		if err := d.Ack(false); err != nil {
+			log.WithFields(log.Fields{
+				"q":     r.replyTo,
+				"id":    d.CorrelationId,
+				"error": err.Error(),
+			}).Error("rbmq rpc: cannot ack")
+		}
+
+		switch {
+		case found:
+			replyCh <- d
+		case late:
+			r.m.Late.Inc()
+			log.WithFields(log.Fields{
+				"q":  r.replyTo,
+				"id": d.CorrelationId,
+			}).Warn("rbmq rpc: late reply")
+		default:
+			r.m.Unmatched.Inc()
+			log.WithFields(log.Fields{
+				"q":  r.replyTo,
+				"id": d.CorrelationId,
+			}).Warn("rbmq rpc: unmatched reply")
+		}
+	}
+}
+
+// Close stops the expired calls cleanup,
+// the notifier and the consumer are closed by their owner
+func (r *RPCClient) Close() {
+	r.sweeper.Stop()
+}
+
+func (r *RPCClient) cleanupExpired() {
+	ttl := time.Duration(r.conf.LateTTL) * time.Second
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, at := range r.expired {
+		if time.Since(at) > ttl {
+			delete(r.expired, id)
+		}
+	}
+}
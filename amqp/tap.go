@@ -0,0 +1,506 @@
+package amqp
+
+// the tap archives the published and consumed messages with their queue, times and outcome
+// to gzipped json lines, the proof of what was sent to the operator.
+// the file is written as name.jsonl.gz.part and renamed to name.jsonl.gz on rotation,
+// only the finished files are uploaded.
+// the record with body has the fields of the admin dump, so the replayer reads the archive,
+// it republishes only the published records
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+	m "github.com/linkit360/go-utils/metrics"
+)
+
+const (
+	TapPublished = "published"
+	TapConsumed  = "consumed"
+)
+
+// outcomes of the archived message
+const (
+	TapOutcomePublished = "published"
+	TapOutcomeFailed    = "failed" // publish error, the notifier retries the message
+	TapOutcomeDropped   = "dropped"
+	TapOutcomeSpilled   = "spilled" // written to the outbox, published later
+	TapOutcomeAcked     = "acked"
+	TapOutcomeNacked    = "nacked"
+	TapOutcomeRejected  = "rejected"
+	TapOutcomeRequeued  = "requeued"
+	TapOutcomeDuplicate = "duplicate"
+	// the source closed before a handler took the delivery, rabbit requeues it
+	TapOutcomeNotHandled = "not_handled"
+)
+
+// TapUploader has the shape of aws.Uploader, the S3 of aws.New type-asserted to it
+type TapUploader interface {
+	Upload(bucket, key string, body io.ReadSeeker) error
+}
+
+type TapRecord struct {
+	Direction     string                 `json:"direction"`
+	Queue         string                 `json:"queue"`
+	EventName     string                 `json:"event_name,omitempty"`
+	Outcome       string                 `json:"outcome"`
+	Error         string                 `json:"error,omitempty"`
+	At            time.Time              `json:"at"` // time of the outcome
+	BufferedAt    *time.Time             `json:"buffered_at,omitempty"`
+	NotBefore     *time.Time             `json:"not_before,omitempty"`
+	ReceivedAt    *time.Time             `json:"received_at,omitempty"`
+	MessageId     string                 `json:"message_id,omitempty"`
+	CorrelationId string                 `json:"correlation_id,omitempty"`
+	ReplyTo       string                 `json:"reply_to,omitempty"`
+	ContentType   string                 `json:"content_type,omitempty"`
+	Priority      uint8                  `json:"priority,omitempty"`
+	Headers       map[string]interface{} `json:"headers,omitempty"`
+	Redelivered   bool                   `json:"redelivered,omitempty"`
+	Body          string                 `json:"body,omitempty"`
+	BodyBase64    []byte                 `json:"body_base64,omitempty"`
+}
+
+type tapMetrics struct {
+	Records  *prometheus.CounterVec
+	Errors   prometheus.Counter
+	Uploaded prometheus.Counter
+}
+
+func initTapMetrics(r *m.Registry) tapMetrics {
+	return tapMetrics{
+		Records:  r.PrometheusCounterVec("rbmq", "tap", "records_total", "rbmq archived messages", []string{"direction", "outcome"}),
+		Errors:   r.PrometheusCounterVec("rbmq", "tap", "errors_total", "rbmq archive write and upload errors", nil).WithLabelValues(),
+		Uploaded: r.PrometheusCounterVec("rbmq", "tap", "uploaded_total", "rbmq archive files uploaded", nil).WithLabelValues(),
+	}
+}
+
+// the sequence of the file names, the taps of one process do not collide
+var tapFileSeq int64
+
+type Tap struct {
+	conf   config.TapConfig
+	m      tapMetrics
+	mu     sync.Mutex
+	file   *os.File
+	gz     *gzip.Writer
+	enc    *json.Encoder
+	part   string // path of the file being written
+	size   int64  // json bytes in the file
+	opened time.Time
+	closed bool
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewTap creates the archive dir, the file is opened on the first record,
+// nil registerer is the default one
+func NewTap(conf config.TapConfig, reg prometheus.Registerer) (*Tap, error) {
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("tap: empty dir")
+	}
+	if conf.Prefix == "" {
+		conf.Prefix = filepath.Base(os.Args[0])
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = 64
+	}
+	if conf.MaxAge <= 0 {
+		conf.MaxAge = 3600
+	}
+	if conf.Flush <= 0 {
+		conf.Flush = 1
+	}
+	for _, r := range conf.Rules {
+		if _, err := path.Match(r.Queue, ""); err != nil {
+			return nil, fmt.Errorf("tap rule queue %s: %s", r.Queue, err.Error())
+		}
+		if _, err := path.Match(r.Event, ""); err != nil {
+			return nil, fmt.Errorf("tap rule event %s: %s", r.Event, err.Error())
+		}
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+
+	t := &Tap{
+		conf: conf,
+		m:    initTapMetrics(m.NewRegistry(reg)),
+		quit: make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.flushLoop()
+	return t, nil
+}
+
+// Match reports the rules archive the message of the queue and event
+func (t *Tap) Match(queue, event string) bool {
+	if len(t.conf.Rules) == 0 {
+		return true
+	}
+	for _, r := range t.conf.Rules {
+		if !patternMatch(r.Queue, queue) || !patternMatch(r.Event, event) {
+			continue
+		}
+		return !r.Exclude
+	}
+	return false
+}
+
+func patternMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// Record writes the record if the rules match it
+func (t *Tap) Record(r TapRecord) {
+	if !t.Match(r.Queue, r.EventName) {
+		return
+	}
+	if r.At.IsZero() {
+		r.At = time.Now().UTC()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	if err := t.write(r); err != nil {
+		t.m.Errors.Inc()
+		log.WithFields(log.Fields{
+			"q":     r.Queue,
+			"e":     r.EventName,
+			"error": err.Error(),
+		}).Error("rbmq tap: write")
+		return
+	}
+	t.m.Records.WithLabelValues(r.Direction, r.Outcome).Inc()
+}
+
+func (t *Tap) write(r TapRecord) error {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			return err
+		}
+	}
+	if err := t.enc.Encode(r); err != nil {
+		return fmt.Errorf("json.Encode: %s", err.Error())
+	}
+	if t.size >= int64(t.conf.MaxSize)*1024*1024 {
+		return t.rotate()
+	}
+	return nil
+}
+
+func (t *Tap) open() error {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s-%d-%d.jsonl.gz",
+		t.conf.Prefix, now.Format("20060102T150405"), os.Getpid(), atomic.AddInt64(&tapFileSeq, 1))
+	part := filepath.Join(t.conf.Dir, name+".part")
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile: %s", err.Error())
+	}
+	t.file = f
+	t.gz = gzip.NewWriter(f)
+	t.enc = json.NewEncoder(countingWriter{w: t.gz, n: &t.size})
+	t.part = part
+	t.size = 0
+	t.opened = now
+	return nil
+}
+
+// rotate finishes the file, the next record opens the new one
+func (t *Tap) rotate() error {
+	if t.file == nil {
+		return nil
+	}
+	f, gz, part := t.file, t.gz, t.part
+	t.file, t.gz, t.enc, t.part = nil, nil, nil, ""
+
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("gzip.Close: %s", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("file.Close: %s", err.Error())
+	}
+	if err := os.Rename(part, part[:len(part)-len(".part")]); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// flushLoop flushes the gzip stream, so the crash loses little,
+// and rotates the file by age when there are no records
+func (t *Tap) flushLoop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(time.Duration(t.conf.Flush) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.quit:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		var err error
+		if t.file != nil {
+			if time.Since(t.opened) >= time.Duration(t.conf.MaxAge)*time.Second {
+				err = t.rotate()
+			} else if err = t.gz.Flush(); err != nil {
+				err = fmt.Errorf("gzip.Flush: %s", err.Error())
+			}
+		}
+		t.mu.Unlock()
+		if err != nil {
+			t.m.Errors.Inc()
+			log.WithField("error", err.Error()).Error("rbmq tap: flush")
+		}
+	}
+}
+
+// newConfiguredTap starts the upload with the uploader when upload is enabled,
+// without the uploader it is started by Tap().SetUploader
+func newConfiguredTap(conf config.TapConfig, u TapUploader, reg prometheus.Registerer) (*Tap, error) {
+	t, err := NewTap(conf, reg)
+	if err != nil {
+		return nil, err
+	}
+	if !conf.Upload.Enabled {
+		return t, nil
+	}
+	if u == nil {
+		log.WithField("dir", conf.Dir).Warn("rbmq tap: upload enabled, no uploader set")
+		return t, nil
+	}
+	if err = t.SetUploader(u); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetUploader uploads the finished files every upload interval
+// and removes them or moves to the uploaded subdir,
+// nothing is uploaded when upload is not enabled
+func (t *Tap) SetUploader(u TapUploader) error {
+	if !t.conf.Upload.Enabled {
+		log.WithField("dir", t.conf.Dir).Info("rbmq tap: upload disabled")
+		return nil
+	}
+	if t.conf.Upload.Bucket == "" {
+		return fmt.Errorf("tap upload: empty bucket")
+	}
+	interval := time.Duration(t.conf.Upload.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.quit:
+				return
+			case <-ticker.C:
+			}
+			if err := t.Upload(u); err != nil {
+				log.WithField("error", err.Error()).Error("rbmq tap: upload")
+			}
+		}
+	}()
+	return nil
+}
+
+// Upload sends the finished files to the bucket,
+// the key is prefix/yyyy/mm/dd/name of the file modification day
+func (t *Tap) Upload(u TapUploader) error {
+	files, err := filepath.Glob(filepath.Join(t.conf.Dir, "*.jsonl.gz"))
+	if err != nil {
+		return fmt.Errorf("filepath.Glob: %s", err.Error())
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if err := t.upload(u, file); err != nil {
+			t.m.Errors.Inc()
+			return err
+		}
+		t.m.Uploaded.Inc()
+	}
+	return nil
+}
+
+func (t *Tap) upload(u TapUploader, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("file.Stat: %s", err.Error())
+	}
+
+	key := path.Join(t.conf.Upload.Prefix, fi.ModTime().UTC().Format("2006/01/02"), filepath.Base(file))
+	if err = u.Upload(t.conf.Upload.Bucket, key, f); err != nil {
+		return fmt.Errorf("%s: %s", file, err.Error())
+	}
+
+	if !t.conf.Upload.Keep {
+		if err = os.Remove(file); err != nil {
+			return fmt.Errorf("os.Remove: %s", err.Error())
+		}
+		return nil
+	}
+	uploaded := filepath.Join(t.conf.Dir, "uploaded")
+	if err = os.MkdirAll(uploaded, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %s", err.Error())
+	}
+	if err = os.Rename(file, filepath.Join(uploaded, filepath.Base(file))); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+// Close finishes the current file, it is uploaded by the next Upload
+func (t *Tap) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.quit)
+	err := t.rotate()
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
+
+func (t *Tap) body(r *TapRecord, body []byte) {
+	if t.conf.SkipBody {
+		return
+	}
+	if utf8.Valid(body) {
+		r.Body = string(body)
+	} else {
+		r.BodyBase64 = body
+	}
+}
+
+func (t *Tap) published(msg AMQPMessage, outcome string, err error) {
+	r := TapRecord{
+		Direction:     TapPublished,
+		Queue:         msg.QueueName,
+		EventName:     msg.EventName,
+		Outcome:       outcome,
+		MessageId:     msg.MessageId,
+		CorrelationId: msg.CorrelationId,
+		ReplyTo:       msg.ReplyTo,
+		ContentType:   msg.ContentType,
+		Priority:      msg.Priority,
+		Headers:       msg.Headers,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if !msg.bufferedAt.IsZero() {
+		bufferedAt := msg.bufferedAt.UTC()
+		r.BufferedAt = &bufferedAt
+	}
+	if !msg.NotBefore.IsZero() {
+		notBefore := msg.NotBefore.UTC()
+		r.NotBefore = &notBefore
+	}
+	t.body(&r, msg.Body)
+	t.Record(r)
+}
+
+func (t *Tap) consumed(queue string, d amqp_driver.Delivery, receivedAt time.Time, outcome string, err error) {
+	var e struct {
+		EventName string `json:"event_name"`
+	}
+	Decode(d, &e)
+
+	receivedAt = receivedAt.UTC()
+	r := TapRecord{
+		Direction:     TapConsumed,
+		Queue:         queue,
+		EventName:     e.EventName,
+		Outcome:       outcome,
+		ReceivedAt:    &receivedAt,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		ContentType:   d.ContentType,
+		Priority:      d.Priority,
+		Headers:       d.Headers,
+		Redelivered:   d.Redelivered,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	t.body(&r, d.Body)
+	t.Record(r)
+}
+
+// SetTap archives the published messages, the tap may be shared with the consumers
+func (n *Notifier) SetTap(t *Tap) {
+	n.tap = t
+}
+
+// Tap returns the tap created by the config, nil if disabled
+func (n *Notifier) Tap() *Tap {
+	return n.tap
+}
+
+// finish archives the publish outcome and ends the producer span
+func (n *Notifier) finish(msg AMQPMessage, outcome string, err error) {
+	if n.tap != nil {
+		n.tap.published(msg, outcome, err)
+	}
+	msg.endSpan(outcome, err)
+}
+
+// SetTap archives the consumed messages with the handler outcome, it must be called before Handle
+func (c *Consumer) SetTap(t *Tap) {
+	c.tap = t
+}
+
+// Tap returns the tap created by the config, nil if disabled
+func (c *Consumer) Tap() *Tap {
+	return c.tap
+}
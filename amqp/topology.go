@@ -0,0 +1,59 @@
+package amqp
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	amqp_driver "github.com/streadway/amqp"
+
+	"github.com/linkit360/go-utils/config"
+)
+
+// DeclareTopology declares all queues of the topology
+// it is safe to call it on every startup, declare is idempotent
+func DeclareTopology(ch Channel, t config.Topology) error {
+	for _, q := range t.Queues {
+		if _, err := queueDeclare(ch, q.Name, &t); err != nil {
+			err = fmt.Errorf("%s Channel.QueueDeclare: %s", q.Name, err.Error())
+			log.WithField("error", err.Error()).Error("rbmq topology declare failed")
+			return err
+		}
+	}
+	log.WithField("queues", len(t.Queues)).Info("rbmq topology declared")
+	return nil
+}
+
+// queueDeclare uses topology options for the queue,
+// the queues out of topology are declared with defaults
+func queueDeclare(ch Channel, name string, t *config.Topology) (amqp_driver.Queue, error) {
+	var opts config.QueueOptions
+	if t != nil {
+		if q, ok := t.Get(name); ok {
+			opts = q.Options
+		}
+	}
+	return queueDeclareWith(ch, name, opts)
+}
+
+func queueDeclareWith(ch Channel, name string, opts config.QueueOptions) (amqp_driver.Queue, error) {
+	return ch.QueueDeclare(
+		name,            // name
+		opts.Durable,    // durable
+		opts.AutoDelete, // delete when unused
+		opts.Exclusive,  // exclusive
+		false,           // no-wait
+		queueArgs(opts), // arguments
+	)
+}
+
+func queueArgs(opts config.QueueOptions) amqp_driver.Table {
+	if opts.MaxPriority == 0 {
+		return amqp_driver.Table(opts.Args)
+	}
+	args := amqp_driver.Table{}
+	for k, v := range opts.Args {
+		args[k] = v
+	}
+	args["x-max-priority"] = int32(opts.MaxPriority)
+	return args
+}
@@ -0,0 +1,112 @@
+package amqp
+
+// the trace context goes in the amqp headers: the notifier starts the producer span
+// when the message is buffered and ends it when the message is published or dropped,
+// the consumer starts the consumer span on delivery and ends it on ack, nack or reject.
+// the delivery headers given to the handler carry the consumer span, see ContextOf
+
+import (
+	"context"
+
+	amqp_driver "github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/linkit360/go-utils/tracing"
+)
+
+const instrumentation = "github.com/linkit360/go-utils/amqp"
+
+// headerCarrier reads and writes the trace context in the amqp headers
+type headerCarrier map[string]interface{}
+
+func (h headerCarrier) Get(key string) string {
+	v, _ := h[key].(string)
+	return v
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = value
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ContextOf returns the context of the delivery trace,
+// the handler passes it to rec and the notifier
+func ContextOf(d amqp_driver.Delivery) context.Context {
+	return tracing.Propagator.Extract(context.Background(), headerCarrier(d.Headers))
+}
+
+// startSpan starts the producer span and injects it to the copy of the message headers
+func (msg *AMQPMessage) startSpan(ctx context.Context) {
+	_, span := otel.Tracer(instrumentation).Start(ctx, "publish "+msg.QueueName,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", msg.QueueName),
+			attribute.String("messaging.message.id", msg.MessageId),
+			attribute.String("rbmq.event", msg.EventName),
+		),
+	)
+	if !span.SpanContext().IsValid() {
+		return
+	}
+	headers := make(map[string]interface{}, len(msg.Headers)+2)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	tracing.Propagator.Inject(trace.ContextWithSpan(ctx, span), headerCarrier(headers))
+	msg.Headers = headers
+	msg.span = span
+}
+
+// endSpan ends the producer span on the final outcome, the failed publish is retried
+func (msg *AMQPMessage) endSpan(outcome string, err error) {
+	if msg.span == nil {
+		return
+	}
+	if err != nil {
+		msg.span.RecordError(err)
+	}
+	if outcome == TapOutcomeFailed {
+		return
+	}
+	msg.span.SetAttributes(attribute.String("rbmq.outcome", outcome))
+	if outcome != TapOutcomePublished {
+		msg.span.SetStatus(codes.Error, outcome)
+	}
+	msg.span.End()
+}
+
+// consumeSpan starts the consumer span of the delivery in the producer trace,
+// the handler gets the headers with the consumer span
+func (p *workerPool) consumeSpan(d *amqp_driver.Delivery) trace.Span {
+	ctx := tracing.Propagator.Extract(context.Background(), headerCarrier(d.Headers))
+	ctx, span := otel.Tracer(instrumentation).Start(ctx, "consume "+p.queue,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.destination.name", p.queue),
+			attribute.String("messaging.message.id", d.MessageId),
+			attribute.Bool("rbmq.redelivered", d.Redelivered),
+		),
+	)
+	if !span.IsRecording() {
+		return nil
+	}
+	headers := make(amqp_driver.Table, len(d.Headers)+2)
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	tracing.Propagator.Inject(ctx, headerCarrier(headers))
+	d.Headers = headers
+	return span
+}
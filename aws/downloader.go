@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -15,6 +16,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/health"
 )
 
 type S3 interface {
@@ -23,8 +26,10 @@ type S3 interface {
 }
 
 type s3downloader struct {
-	s3   *s3.S3
-	conf Config
+	s3      *s3.S3
+	conf    Config
+	mu      sync.Mutex
+	lastErr error // of the last s3 request, for the health check
 }
 
 type Config struct {
@@ -32,6 +37,7 @@ type Config struct {
 	Id              string        `yaml:"access_key_id"`
 	Secret          string        `yaml:"secret_access_key"`
 	DownloadTimeout time.Duration `yaml:"download_timeout"` // 2 minutes
+	UploadTimeout   time.Duration `yaml:"upload_timeout"`
 }
 
 func New(s3Conf Config) S3 {
@@ -50,6 +56,7 @@ func New(s3Conf Config) S3 {
 		s3:   s3.New(sess),
 		conf: s3Conf,
 	}
+	health.Register("aws_s3", false, s3dl)
 	log.WithFields(log.Fields{}).Info("aws init ok")
 	return s3dl
 }
@@ -128,6 +135,7 @@ func (s *s3downloader) Download(bucket, key string) (content []byte, contentLeng
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
+	s.observe(err)
 
 	if err != nil {
 		err = fmt.Errorf("Download: %s, error: %s", key, err.Error())
@@ -175,3 +183,23 @@ func (s *s3downloader) Download(bucket, key string) (content []byte, contentLeng
 	}).Info("download done")
 	return content, contentLength, nil
 }
+
+// observe keeps the error of the s3 request, the missing object is not a failure
+func (s *s3downloader) observe(err error) {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		err = nil
+	}
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+// Check reports the last s3 request failed
+func (s *s3downloader) Check(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastErr != nil {
+		return fmt.Errorf("last request: %s", s.lastErr.Error())
+	}
+	return nil
+}
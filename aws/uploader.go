@@ -0,0 +1,49 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Uploader is implemented by the S3 of New,
+// the S3 is type-asserted to it: up, ok := s3.(aws.Uploader)
+type Uploader interface {
+	Upload(bucket, key string, body io.ReadSeeker) error
+}
+
+func (s *s3downloader) Upload(bucket, key string, body io.ReadSeeker) error {
+	ctx := context.Background()
+	if s.conf.UploadTimeout > 0 {
+		var cancelFn func()
+		ctx, cancelFn = context.WithTimeout(ctx, s.conf.UploadTimeout)
+		defer cancelFn()
+	}
+
+	_, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	s.observe(err)
+	if err != nil {
+		err = fmt.Errorf("Upload: %s, error: %s", key, err.Error())
+		log.WithFields(log.Fields{
+			"bucket":  bucket,
+			"key":     key,
+			"timeout": s.conf.UploadTimeout,
+			"error":   err.Error(),
+		}).Error("failed to upload object")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"bucket": bucket,
+		"key":    key,
+	}).Info("upload done")
+	return nil
+}
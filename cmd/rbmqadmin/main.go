@@ -0,0 +1,232 @@
+package main
+
+// rbmqadmin inspects and repairs the operator queues
+//
+//	rbmqadmin -config rbmqadmin.yml list [operator ...]
+//	rbmqadmin -config rbmqadmin.yml peek <queue> [n]
+//	rbmqadmin -config rbmqadmin.yml move <from> <to> [n]
+//	rbmqadmin -config rbmqadmin.yml [-yes] purge <queue>
+//	rbmqadmin -config rbmqadmin.yml [-remove] dump <queue> <file.jsonl>
+//	rbmqadmin -config rbmqadmin.yml restore <file.jsonl> [queue]
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jinzhu/configor"
+
+	"github.com/linkit360/go-utils/amqp"
+	"github.com/linkit360/go-utils/config"
+)
+
+type AdminConfig struct {
+	Conn      amqp.ConnectionConfig   `yaml:"conn"`
+	Operators []config.OperatorConfig `yaml:"operators"`
+}
+
+func main() {
+	configPath := flag.String("config", "rbmqadmin.yml", "configuration yml file")
+	uri := flag.String("uri", "", "amqp uri, overrides the config connection")
+	timeout := flag.Duration("timeout", 10*time.Second, "connect timeout")
+	yes := flag.Bool("yes", false, "purge without confirmation")
+	remove := flag.Bool("remove", false, "dump removes the messages from the queue")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var conf AdminConfig
+	if err := configor.Load(&conf, *configPath); err != nil && *uri == "" {
+		fatal("config load: %s", err.Error())
+	}
+	if *uri != "" {
+		conf.Conn.URI = *uri
+	}
+
+	conn := amqp.NewConnectionWithDialer(conf.Conn, 1, amqp.DialDriver)
+	select {
+	case <-conn.Ready():
+	case <-time.After(*timeout):
+		fatal("rbmq connect: timeout %s", timeout.String())
+	}
+	defer conn.Close()
+	admin := amqp.NewAdmin(conn)
+	// move and restore declare only the missing target queues with their configured options,
+	// the other commands do not declare anything
+	if len(conf.Operators) > 0 {
+		admin.SetTopology(config.NewTopology(conf.Operators))
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		list(admin, conf.Operators, args)
+	case "peek":
+		need(args, 1)
+		peek(admin, args[0], intArg(args, 1, 10))
+	case "move":
+		need(args, 2)
+		moved, err := admin.Move(args[0], args[1], intArg(args, 2, 0))
+		fmt.Printf("moved %d from %s to %s\n", moved, args[0], args[1])
+		check(err)
+	case "purge":
+		need(args, 1)
+		purge(admin, args[0], *yes)
+	case "dump":
+		need(args, 2)
+		dump(admin, args[0], args[1], *remove)
+	case "restore":
+		need(args, 1)
+		queue := ""
+		if len(args) > 1 {
+			queue = args[1]
+		}
+		restore(admin, args[0], queue)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: rbmqadmin [flags] <command> [args]
+
+commands:
+  list [operator ...]          queues of the operators with depth and consumers
+  peek <queue> [n]             show n messages from the queue head, 10 by default
+  move <from> <to> [n]         move n messages, all by default
+  purge <queue>                remove the ready messages, asks for confirmation
+  dump <queue> <file>          write the messages to json lines file
+  restore <file> [queue]       publish the dumped messages to the queue or to their queues
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func list(admin *amqp.Admin, operators []config.OperatorConfig, names []string) {
+	if len(names) > 0 {
+		selected := make(map[string]bool)
+		for _, name := range names {
+			selected[name] = true
+		}
+		var filtered []config.OperatorConfig
+		for _, oc := range operators {
+			if selected[oc.Name] {
+				oc.Enabled = true
+				filtered = append(filtered, oc)
+				delete(selected, oc.Name)
+			}
+		}
+		// operators missing in config have the default queues
+		for name := range selected {
+			filtered = append(filtered, config.OperatorConfig{Name: name, Enabled: true})
+		}
+		operators = filtered
+	}
+	topology := config.NewTopology(operators)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tOPERATOR\tDIRECTION\tMESSAGES\tCONSUMERS")
+	for _, name := range topology.Names() {
+		q, _ := topology.Get(name)
+		info, err := admin.Inspect(name)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\t%s\tnot found\t-\n", name, q.Operator, q.Direction)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", name, q.Operator, q.Direction, info.Messages, info.Consumers)
+	}
+	w.Flush()
+}
+
+func peek(admin *amqp.Admin, queue string, n int) {
+	msgs, err := admin.Peek(queue, n)
+	for i, d := range msgs {
+		fmt.Printf("#%d content_type=%s priority=%d redelivered=%t message_id=%s\n",
+			i+1, d.ContentType, d.Priority, d.Redelivered, d.MessageId)
+		var e amqp.EventNotify
+		if decodeErr := amqp.Decode(d, &e); decodeErr != nil || e.EventName == "" {
+			fmt.Printf("  body: %s\n", string(d.Body))
+			continue
+		}
+		data, _ := json.MarshalIndent(e.EventData, "  ", "  ")
+		fmt.Printf("  event: %s\n  data: %s\n", e.EventName, string(data))
+	}
+	fmt.Printf("%d messages\n", len(msgs))
+	check(err)
+}
+
+func purge(admin *amqp.Admin, queue string, yes bool) {
+	info, err := admin.Inspect(queue)
+	check(err)
+	if !yes {
+		fmt.Printf("purge %d messages from %s? [y/N] ", info.Messages, queue)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("cancelled")
+			return
+		}
+	}
+	purged, err := admin.Purge(queue)
+	check(err)
+	fmt.Printf("purged %d from %s\n", purged, queue)
+}
+
+func dump(admin *amqp.Admin, queue, path string, remove bool) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	check(err)
+	defer f.Close()
+	dumped, err := admin.Dump(queue, f, remove)
+	fmt.Printf("dumped %d from %s to %s\n", dumped, queue, path)
+	check(err)
+}
+
+func restore(admin *amqp.Admin, path, queue string) {
+	f, err := os.Open(path)
+	check(err)
+	defer f.Close()
+	restored, err := admin.Restore(queue, f)
+	fmt.Printf("restored %d from %s\n", restored, path)
+	check(err)
+}
+
+func need(args []string, n int) {
+	if len(args) < n {
+		usage()
+		os.Exit(2)
+	}
+}
+
+func intArg(args []string, i, def int) int {
+	if len(args) <= i {
+		return def
+	}
+	n, err := strconv.Atoi(args[i])
+	if err != nil {
+		fatal("%s: not a number", args[i])
+	}
+	return n
+}
+
+func check(err error) {
+	if err != nil {
+		fatal("%s", err.Error())
+	}
+}
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rbmqadmin: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,129 @@
+package main
+
+// rbmqreplay republishes the archived json lines through the notifier
+//
+//	rbmqreplay -config rbmqreplay.yml [-queue q] [-rate 100] [-dry-run] [-drain 1m]
+//	    [-checkpoint replay.checkpoint] [-events e1,e2] [-msisdns m1,m2]
+//	    [-from 2017-01-02T15:04:05Z] [-to 2017-01-03T00:00:00Z] dump.jsonl ...
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jinzhu/configor"
+
+	"github.com/linkit360/go-utils/amqp"
+	"github.com/linkit360/go-utils/replay"
+)
+
+type ReplayConfig struct {
+	Notifier amqp.NotifierConfig `yaml:"notifier"`
+	Replay   replay.Config       `yaml:"replay"`
+}
+
+func main() {
+	configPath := flag.String("config", "rbmqreplay.yml", "configuration yml file")
+	uri := flag.String("uri", "", "amqp uri, overrides the config connection")
+	queue := flag.String("queue", "", "target queue, overrides the queue of the messages")
+	rate := flag.Int("rate", -1, "messages per second, 0 - unlimited")
+	dryRun := flag.Bool("dry-run", false, "log the messages, do not publish")
+	checkpoint := flag.String("checkpoint", "", "checkpoint file to resume the replay")
+	events := flag.String("events", "", "comma separated event names")
+	msisdns := flag.String("msisdns", "", "comma separated msisdns")
+	from := flag.String("from", "", "RFC3339 time, replay the messages since")
+	to := flag.String("to", "", "RFC3339 time, replay the messages before")
+	drain := flag.Duration("drain", 0, "wait for the notifier to publish the buffered messages, overrides the config drain_timeout")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: rbmqreplay [flags] dump.jsonl ...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var conf ReplayConfig
+	if err := configor.Load(&conf, *configPath); err != nil && *uri == "" {
+		fatal("config load: %s", err.Error())
+	}
+	if *uri != "" {
+		conf.Notifier.Conn.URI = *uri
+	}
+	rc := &conf.Replay
+	if *queue != "" {
+		rc.Queue = *queue
+	}
+	if *rate >= 0 {
+		rc.Rate = *rate
+	}
+	if *dryRun {
+		rc.DryRun = true
+	}
+	if *checkpoint != "" {
+		rc.Checkpoint = *checkpoint
+	}
+	if *events != "" {
+		rc.EventNames = strings.Split(*events, ",")
+	}
+	if *msisdns != "" {
+		rc.Msisdns = strings.Split(*msisdns, ",")
+	}
+	if *drain > 0 {
+		rc.DrainTimeout = int((*drain + time.Second - 1) / time.Second)
+	}
+	rc.From = timeArg(*from, rc.From)
+	rc.To = timeArg(*to, rc.To)
+
+	var notifier *amqp.Notifier
+	var publisher replay.Publisher
+	if !rc.DryRun {
+		notifier = amqp.NewNotifier(conf.Notifier)
+		publisher = notifier
+	}
+	r, err := replay.New(*rc, publisher)
+	if err != nil {
+		fatal("%s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	for _, path := range flag.Args() {
+		stats, err := r.Replay(ctx, path)
+		fmt.Printf("%s: read %d, resumed %d, filtered %d, published %d, failed %d\n",
+			path, stats.Read, stats.Resumed, stats.Filtered, stats.Published, stats.Failed)
+		if err != nil {
+			fatal("%s: %s", path, err.Error())
+		}
+	}
+	// the notifier publishes from its buffers
+	if err = r.Drain(); err != nil {
+		fatal("%s", err.Error())
+	}
+}
+
+func timeArg(value string, def time.Time) time.Time {
+	if value == "" {
+		return def
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		fatal("%s: %s", value, err.Error())
+	}
+	return t
+}
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rbmqreplay: "+format+"\n", args...)
+	os.Exit(1)
+}
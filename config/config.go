@@ -1,5 +1,7 @@
 package config
 
+import "fmt"
+
 const (
 	NEW_SUBSCRIPTION_SUFFIX = "_new_subscriptions"
 	MO_TARIFFICATE          = "_mo_tarifficate"
@@ -10,10 +12,79 @@ const (
 )
 
 type ConsumeQueueConfig struct {
-	Name          string `yaml:"name"`
-	Enabled       bool   `yaml:"enabled" default:"false"`
-	PrefetchCount int    `yaml:"prefetch_count" default:"600"`
-	ThreadsCount  int    `yaml:"threads_count" default:"60"`
+	Name          string          `yaml:"name"`
+	Enabled       bool            `yaml:"enabled" default:"false"`
+	PrefetchCount int             `yaml:"prefetch_count" default:"600"`
+	ThreadsCount  int             `yaml:"threads_count" default:"60"`
+	Autoscale     AutoscaleConfig `yaml:"autoscale"`
+	Dedup         DedupConfig     `yaml:"dedup"`
+}
+
+// the consumer acks the already handled messages without calling the handler
+type DedupConfig struct {
+	Enabled   bool   `yaml:"enabled" default:"false"`
+	Key       string `yaml:"key" default:"message_id"`              // message_id or the event_data field, for example, tid
+	TTL       int    `yaml:"ttl" default:"86400"`                   // seconds the handled key is remembered
+	Store     string `yaml:"store" default:"memory"`                // memory or postgres
+	CacheSize int    `yaml:"cache_size" default:"100000"`           // in-memory keys, the postgres store caches them too
+	Table     string `yaml:"table" default:"xmp_consumed_messages"` // of the postgres store
+}
+
+// Validate rejects the stores InitConsumer cannot create,
+// the postgres store needs the db and is set with Consumer.SetDedup
+func (c DedupConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	switch c.Store {
+	case "", "memory":
+		return nil
+	case "postgres":
+		return fmt.Errorf("dedup store postgres needs the db: " +
+			"use NewConsumer, SetDedup(amqp.NewPostgresDedup(conf, db)) and InitQueue instead of InitConsumer")
+	default:
+		return fmt.Errorf("unknown dedup store %s", c.Store)
+	}
+}
+
+// the tap archives the published and consumed messages to rotating gzipped json lines
+// and uploads the finished files to s3. the first matching rule decides,
+// no rules archive everything, the rules without match skip the message
+type TapConfig struct {
+	Enabled  bool            `yaml:"enabled" default:"false"`
+	Dir      string          `yaml:"dir" default:"/var/spool/linkit/tap"`
+	Prefix   string          `yaml:"prefix" default:""`         // file name prefix, the binary name by default
+	MaxSize  int             `yaml:"max_size" default:"64"`     // megabytes of json before the file is rotated
+	MaxAge   int             `yaml:"max_age" default:"3600"`    // seconds before the file is rotated
+	Flush    int             `yaml:"flush" default:"1"`         // seconds between flushes to the file
+	SkipBody bool            `yaml:"skip_body" default:"false"` // do not archive the message body
+	Rules    []TapRule       `yaml:"rules"`                     // queue and event filters
+	Upload   TapUploadConfig `yaml:"upload"`
+}
+
+// queue and event are path.Match patterns, empty matches any
+type TapRule struct {
+	Queue   string `yaml:"queue"`
+	Event   string `yaml:"event"`
+	Exclude bool   `yaml:"exclude" default:"false"`
+}
+
+type TapUploadConfig struct {
+	Enabled  bool   `yaml:"enabled" default:"false"`
+	Bucket   string `yaml:"bucket"`
+	Prefix   string `yaml:"prefix" default:"tap"`   // key is prefix/yyyy/mm/dd/file
+	Interval int    `yaml:"interval" default:"300"` // seconds between uploads
+	Keep     bool   `yaml:"keep" default:"false"`   // move uploaded files to uploaded subdir instead of removing
+}
+
+// the consumer grows or shrinks the workers count between min and max threads
+// to handle the queue depth in one interval, prefetch follows the workers count
+type AutoscaleConfig struct {
+	Enabled           bool `yaml:"enabled" default:"false"`
+	MinThreads        int  `yaml:"min_threads" default:"10"`
+	MaxThreads        int  `yaml:"max_threads" default:"200"`
+	Interval          int  `yaml:"interval" default:"30"` // seconds
+	PrefetchPerThread int  `yaml:"prefetch_per_thread" default:"10"`
 }
 
 type OperatorConfig struct {
@@ -24,6 +95,7 @@ type OperatorConfig struct {
 		QueueSize   int  `default:"1200" yaml:"queue_size,omitempty"`
 		FromDBCount int  `default:"1200" yaml:"from_db_count,omitempty"`
 	} `yaml:"retries"`
+	QueueOptions QueueOptions `yaml:"queue_options"`
 }
 
 func (oc OperatorConfig) NewSubscriptionQueueName() string {
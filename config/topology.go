@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// queue direction from the operator service point of view
+type QueueDirection string
+
+const (
+	// the operator service consumes the queue
+	DirectionIn QueueDirection = "in"
+	// the operator service publishes to the queue
+	DirectionOut QueueDirection = "out"
+)
+
+// queue declare options, the same options must be used by everyone
+// who declares the queue, otherwise rabbit closes the channel
+type QueueOptions struct {
+	Durable     bool                   `yaml:"durable" default:"false"`
+	AutoDelete  bool                   `yaml:"auto_delete" default:"false"`
+	Exclusive   bool                   `yaml:"exclusive" default:"false"`
+	MaxPriority uint8                  `yaml:"max_priority" default:"0"` // x-max-priority, 0 - not a priority queue
+	Args        map[string]interface{} `yaml:"args,omitempty"`
+}
+
+type TopologyQueue struct {
+	Name      string         `json:"name"`
+	Operator  string         `json:"operator"`
+	Direction QueueDirection `json:"direction"`
+	Options   QueueOptions   `json:"options"`
+}
+
+// every queue the operator has
+var operatorQueues = []struct {
+	suffix    string
+	direction QueueDirection
+}{
+	{NEW_SUBSCRIPTION_SUFFIX, DirectionIn},
+	{MO_TARIFFICATE, DirectionIn},
+	{REQUESTS_SUFFIX, DirectionIn},
+	{RESPONSES_SUFFIX, DirectionOut},
+	{SMS_REQUEST_SUFFIX, DirectionIn},
+	{SMS_RESPONSE_SUFFIX, DirectionOut},
+}
+
+// Topology holds all queues of the operators
+type Topology struct {
+	Queues []TopologyQueue `json:"queues"`
+	index  map[string]int
+}
+
+// NewTopology enumerates queues of the enabled operators
+func NewTopology(operators []OperatorConfig) Topology {
+	t := Topology{
+		index: make(map[string]int),
+	}
+	for _, oc := range operators {
+		if !oc.Enabled {
+			continue
+		}
+		for _, q := range operatorQueues {
+			t.Add(TopologyQueue{
+				Name:      oc.Name + q.suffix,
+				Operator:  oc.Name,
+				Direction: q.direction,
+				Options:   oc.QueueOptions,
+			})
+		}
+	}
+	return t
+}
+
+// Add adds the queue not bound to operators list, for example, the service queue
+func (t *Topology) Add(q TopologyQueue) {
+	if t.index == nil {
+		t.index = make(map[string]int)
+	}
+	if i, ok := t.index[q.Name]; ok {
+		t.Queues[i] = q
+		return
+	}
+	t.index[q.Name] = len(t.Queues)
+	t.Queues = append(t.Queues, q)
+}
+
+func (t Topology) Get(name string) (TopologyQueue, bool) {
+	i, ok := t.index[name]
+	if !ok {
+		return TopologyQueue{}, false
+	}
+	return t.Queues[i], true
+}
+
+func (t Topology) Has(name string) bool {
+	_, ok := t.index[name]
+	return ok
+}
+
+func (t Topology) OperatorQueues(operatorName string) (queues []TopologyQueue) {
+	for _, q := range t.Queues {
+		if q.Operator == operatorName {
+			queues = append(queues, q)
+		}
+	}
+	return
+}
+
+func (t Topology) Names() []string {
+	names := make([]string, 0, len(t.Queues))
+	for _, q := range t.Queues {
+		names = append(names, q.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the enabled consumers read from the queues of the topology
+// and InitConsumer can create their dedup
+func (t Topology) Validate(consumers ...ConsumeQueueConfig) error {
+	for _, qc := range consumers {
+		if !qc.Enabled {
+			continue
+		}
+		if !t.Has(qc.Name) {
+			return fmt.Errorf("queue %s not found in topology", qc.Name)
+		}
+		if err := qc.Dedup.Validate(); err != nil {
+			return fmt.Errorf("queue %s: %s", qc.Name, err.Error())
+		}
+	}
+	return nil
+}
@@ -1,14 +1,19 @@
 package cqr
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/health"
 )
 
 func init() {
@@ -39,6 +44,7 @@ func InitCQR(cqrConfigs []CQRConfig) error {
 	log.WithFields(log.Fields{
 		"tables": strings.Join(tableNames, ", "),
 	}).Debug("init request")
+	health.Register("cqr", false, health.CheckerFunc(Check))
 
 	for _, cqrConfig := range cqrConfigs {
 		if !cqrConfig.Enabled {
@@ -51,7 +57,9 @@ func InitCQR(cqrConfigs []CQRConfig) error {
 		log.WithFields(log.Fields{
 			"cqr": fmt.Sprintf("%#v", cqrConfig),
 		}).Debug("cqr reload...")
-		if err := cqrConfig.Data.Reload(); err != nil {
+		err := cqrConfig.Data.Reload()
+		reloaded(cqrConfig.Tables, err)
+		if err != nil {
 			err = fmt.Errorf("%s: %s", cqrConfig.Tables, err.Error())
 			log.WithFields(log.Fields{
 				"table": cqrConfig.Tables,
@@ -121,6 +129,7 @@ func CQRReloadFunc(cqrConfigs []CQRConfig, c *gin.Context) func(*gin.Context) {
 					found = true
 					begin := time.Now()
 					err := cqrConfig.Data.Reload()
+					reloaded(cqrConfig.Tables, err)
 					if err != nil {
 						r.Success = false
 						r.Err = err
@@ -180,6 +189,38 @@ func CQRReloadFunc(cqrConfigs []CQRConfig, c *gin.Context) func(*gin.Context) {
 	return fn
 }
 
+// last reload errors by the tables, for the health check
+var reloads = struct {
+	sync.Mutex
+	failed map[string]error
+}{failed: make(map[string]error)}
+
+func reloaded(tables []string, err error) {
+	key := strings.Join(tables, ", ")
+	reloads.Lock()
+	defer reloads.Unlock()
+	if err != nil {
+		reloads.failed[key] = err
+	} else {
+		delete(reloads.failed, key)
+	}
+}
+
+// Check reports the tables whose last reload failed
+func Check(ctx context.Context) error {
+	reloads.Lock()
+	defer reloads.Unlock()
+	if len(reloads.failed) == 0 {
+		return nil
+	}
+	var failed []string
+	for tables, err := range reloads.failed {
+		failed = append(failed, tables+": "+err.Error())
+	}
+	sort.Strings(failed)
+	return fmt.Errorf("reload failed: %s", strings.Join(failed, "; "))
+}
+
 type response struct {
 	Success bool        `json:"success,omitempty"`
 	Err     error       `json:"error,omitempty"`
@@ -0,0 +1,253 @@
+package envelope
+
+// versioned envelope of the queue events.
+// it is a superset of {event_name, event_data}, so the consumers of amqp.EventNotify
+// read the envelope, and the envelope decoder reads the old messages as version 1.
+// event data of the older versions are upgraded step by step to the latest registered version.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+
+	"github.com/linkit360/go-utils/tracing"
+)
+
+// Source is written to the envelopes of the process, the binary name by default
+var Source = filepath.Base(os.Args[0])
+
+type Envelope struct {
+	EventId    string      `json:"event_id,omitempty"`
+	EventName  string      `json:"event_name,omitempty"`
+	Version    int         `json:"version,omitempty"`
+	OccurredAt time.Time   `json:"occurred_at,omitempty"`
+	Source     string      `json:"source,omitempty"`
+	TraceId    string      `json:"trace_id,omitempty"`
+	EventData  interface{} `json:"event_data,omitempty"`
+}
+
+// raw is the envelope before the event data is decoded
+type raw struct {
+	EventId    string          `json:"event_id,omitempty"`
+	EventName  string          `json:"event_name,omitempty"`
+	Version    int             `json:"version,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	TraceId    string          `json:"trace_id,omitempty"`
+	EventData  json.RawMessage `json:"event_data,omitempty"`
+}
+
+type DecodeMode int
+
+const (
+	// unknown events, versions and event data fields are errors
+	Strict DecodeMode = iota
+	// unknown events and newer versions keep json.RawMessage event data and their version,
+	// unknown fields are ignored
+	Lenient
+)
+
+// UpgradeFunc converts the event data of the version to the next version
+type UpgradeFunc func(data json.RawMessage) (json.RawMessage, error)
+
+type key struct {
+	eventName string
+	version   int
+}
+
+// Registry maps the event name and version to the event data type
+type Registry struct {
+	mu       sync.RWMutex
+	types    map[key]reflect.Type
+	upgrades map[key]UpgradeFunc
+	latest   map[string]int
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		types:    make(map[key]reflect.Type),
+		upgrades: make(map[key]UpgradeFunc),
+		latest:   make(map[string]int),
+	}
+}
+
+// DefaultRegistry is used by the package functions
+var DefaultRegistry = NewRegistry()
+
+// Register maps the version of the event to the type of the sample, for example, rec.Record{}
+func (r *Registry) Register(eventName string, version int, sample interface{}) {
+	t := reflect.TypeOf(sample)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[key{eventName, version}] = t
+	if version > r.latest[eventName] {
+		r.latest[eventName] = version
+	}
+}
+
+// RegisterUpgrade sets the conversion of the event data from the version to the next one
+func (r *Registry) RegisterUpgrade(eventName string, from int, fn UpgradeFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upgrades[key{eventName, from}] = fn
+}
+
+// Latest returns the latest registered version of the event, 0 if unknown
+func (r *Registry) Latest(eventName string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.latest[eventName]
+}
+
+// Events returns the registered event names
+func (r *Registry) Events() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.latest))
+	for name := range r.latest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New wraps the event data to the envelope of the latest registered version
+func (r *Registry) New(eventName string, data interface{}) Envelope {
+	return r.NewContext(context.Background(), eventName, data)
+}
+
+// NewContext sets the trace id of the span in ctx
+func (r *Registry) NewContext(ctx context.Context, eventName string, data interface{}) Envelope {
+	version := r.Latest(eventName)
+	if version == 0 {
+		version = 1
+	}
+	e := Envelope{
+		EventName:  eventName,
+		Version:    version,
+		OccurredAt: time.Now().UTC(),
+		Source:     Source,
+		TraceId:    tracing.TraceId(ctx),
+		EventData:  data,
+	}
+	if u4, err := uuid.NewV4(); err == nil {
+		e.EventId = u4.String()
+	}
+	return e
+}
+
+// Decode reads the envelope and decodes the event data to the latest registered type,
+// the event data is a pointer to the type
+func (r *Registry) Decode(body []byte, mode DecodeMode) (e Envelope, err error) {
+	var re raw
+	if err = unmarshal(body, &re, Lenient); err != nil {
+		return e, fmt.Errorf("json.Unmarshal: %s", err.Error())
+	}
+	e = Envelope{
+		EventId:    re.EventId,
+		EventName:  re.EventName,
+		Version:    re.Version,
+		OccurredAt: re.OccurredAt,
+		Source:     re.Source,
+		TraceId:    re.TraceId,
+	}
+	if e.Version == 0 {
+		// published before the envelope
+		e.Version = 1
+	}
+
+	latest := r.Latest(e.EventName)
+	if latest == 0 {
+		if mode == Strict {
+			return e, fmt.Errorf("event %s: not registered", e.EventName)
+		}
+		e.EventData = re.EventData
+		return e, nil
+	}
+
+	if e.Version > latest {
+		if mode == Strict {
+			return e, fmt.Errorf("event %s: version %d is newer than %d", e.EventName, e.Version, latest)
+		}
+		// the older type would lose the new fields
+		e.EventData = re.EventData
+		return e, nil
+	}
+	data, err := r.upgrade(e.EventName, e.Version, latest, re.EventData)
+	if err != nil {
+		return e, err
+	}
+
+	r.mu.RLock()
+	t, ok := r.types[key{e.EventName, latest}]
+	r.mu.RUnlock()
+	if !ok {
+		return e, fmt.Errorf("event %s: version %d type not registered", e.EventName, latest)
+	}
+	v := reflect.New(t)
+	if len(data) > 0 {
+		if err = unmarshal(data, v.Interface(), mode); err != nil {
+			return e, fmt.Errorf("event %s version %d: json.Unmarshal: %s", e.EventName, latest, err.Error())
+		}
+	}
+	e.Version = latest
+	e.EventData = v.Interface()
+	return e, nil
+}
+
+func (r *Registry) upgrade(eventName string, from, to int, data json.RawMessage) (json.RawMessage, error) {
+	for version := from; version < to; version++ {
+		r.mu.RLock()
+		fn, ok := r.upgrades[key{eventName, version}]
+		r.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("event %s: no upgrade from version %d", eventName, version)
+		}
+		var err error
+		if data, err = fn(data); err != nil {
+			return nil, fmt.Errorf("event %s: upgrade from version %d: %s", eventName, version, err.Error())
+		}
+	}
+	return data, nil
+}
+
+func unmarshal(data []byte, v interface{}, mode DecodeMode) error {
+	if mode == Lenient {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func Register(eventName string, version int, sample interface{}) {
+	DefaultRegistry.Register(eventName, version, sample)
+}
+
+func RegisterUpgrade(eventName string, from int, fn UpgradeFunc) {
+	DefaultRegistry.RegisterUpgrade(eventName, from, fn)
+}
+
+func New(eventName string, data interface{}) Envelope {
+	return DefaultRegistry.New(eventName, data)
+}
+
+func NewContext(ctx context.Context, eventName string, data interface{}) Envelope {
+	return DefaultRegistry.NewContext(ctx, eventName, data)
+}
+
+func Decode(body []byte, mode DecodeMode) (Envelope, error) {
+	return DefaultRegistry.Decode(body, mode)
+}
@@ -0,0 +1,152 @@
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type chargeV1 struct {
+	Msisdn string `json:"msisdn"`
+}
+
+type chargeV2 struct {
+	Msisdn string `json:"msisdn"`
+	Tid    string `json:"tid"`
+}
+
+type chargeV3 struct {
+	Phone string `json:"phone"`
+	Tid   string `json:"tid"`
+}
+
+func chargeRegistry() *Registry {
+	r := NewRegistry()
+	r.Register("charge", 1, chargeV1{})
+	r.Register("charge", 2, chargeV2{})
+	r.Register("charge", 3, &chargeV3{})
+	r.RegisterUpgrade("charge", 1, func(data json.RawMessage) (json.RawMessage, error) {
+		var v1 chargeV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return nil, err
+		}
+		return json.Marshal(chargeV2{Msisdn: v1.Msisdn, Tid: "unknown"})
+	})
+	r.RegisterUpgrade("charge", 2, func(data json.RawMessage) (json.RawMessage, error) {
+		var v2 chargeV2
+		if err := json.Unmarshal(data, &v2); err != nil {
+			return nil, err
+		}
+		return json.Marshal(chargeV3{Phone: v2.Msisdn, Tid: v2.Tid})
+	})
+	r.Register("refund", 1, chargeV1{})
+	r.Register("refund", 2, chargeV2{})
+	return r
+}
+
+func TestDecodeUpgrades(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want chargeV3
+	}{
+		{"event notify", `{"event_name":"charge","event_data":{"msisdn":"7999"}}`, chargeV3{"7999", "unknown"}},
+		{"version 1", `{"event_name":"charge","version":1,"event_data":{"msisdn":"7999"}}`, chargeV3{"7999", "unknown"}},
+		{"version 2", `{"event_name":"charge","version":2,"event_data":{"msisdn":"7999","tid":"t1"}}`, chargeV3{"7999", "t1"}},
+		{"latest", `{"event_name":"charge","version":3,"event_data":{"phone":"7999","tid":"t1"}}`, chargeV3{"7999", "t1"}},
+		{"no event data", `{"event_name":"charge","version":3}`, chargeV3{}},
+	}
+	r := chargeRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []DecodeMode{Strict, Lenient} {
+				e, err := r.Decode([]byte(tt.body), mode)
+				if err != nil {
+					t.Fatalf("mode %d: %s", mode, err.Error())
+				}
+				data, ok := e.EventData.(*chargeV3)
+				if !ok {
+					t.Fatalf("mode %d: event data %T", mode, e.EventData)
+				}
+				if e.Version != 3 || *data != tt.want {
+					t.Fatalf("mode %d: version %d, %+v, want %+v", mode, e.Version, *data, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		strict  bool // strict mode decodes it
+		version int  // lenient mode version
+		raw     bool // lenient mode keeps json.RawMessage
+	}{
+		{"unknown event", `{"event_name":"bill","version":2,"event_data":{"a":1}}`, false, 2, true},
+		{"newer version", `{"event_name":"charge","version":4,"event_data":{"phone":"7999"}}`, false, 4, true},
+		{"unknown field", `{"event_name":"charge","version":3,"event_data":{"phone":"7999","x":1}}`, false, 3, false},
+		{"no upgrade", `{"event_name":"refund","version":1,"event_data":{"msisdn":"7999"}}`, false, 0, false},
+		{"not json", `charge`, false, 0, false},
+	}
+	r := chargeRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := r.Decode([]byte(tt.body), Strict); (err == nil) != tt.strict {
+				t.Fatalf("strict: %v", err)
+			}
+			e, err := r.Decode([]byte(tt.body), Lenient)
+			if tt.version == 0 {
+				if err == nil {
+					t.Fatal("lenient: no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lenient: %s", err.Error())
+			}
+			if e.Version != tt.version {
+				t.Fatalf("lenient: version %d, want %d", e.Version, tt.version)
+			}
+			if _, raw := e.EventData.(json.RawMessage); raw != tt.raw {
+				t.Fatalf("lenient: event data %T", e.EventData)
+			}
+		})
+	}
+}
+
+// the envelope is read by the consumers of {event_name, event_data}
+func TestNewRoundTrip(t *testing.T) {
+	r := chargeRegistry()
+	e := r.New("charge", chargeV3{Phone: "7999", Tid: "t1"})
+	if e.Version != 3 || e.EventId == "" || e.Source != Source || e.OccurredAt.IsZero() {
+		t.Fatalf("envelope %+v", e)
+	}
+	if v := r.New("bill", nil).Version; v != 1 {
+		t.Fatalf("unknown event version %d", v)
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notify struct {
+		EventName string                 `json:"event_name"`
+		EventData map[string]interface{} `json:"event_data"`
+	}
+	if err = json.Unmarshal(body, &notify); err != nil {
+		t.Fatal(err)
+	}
+	if notify.EventName != "charge" || notify.EventData["phone"] != "7999" {
+		t.Fatalf("event notify %+v", notify)
+	}
+
+	decoded, err := r.Decode(body, Strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.EventId != e.EventId || fmt.Sprint(decoded.EventData) != fmt.Sprint(&chargeV3{"7999", "t1"}) {
+		t.Fatalf("decoded %+v", decoded)
+	}
+}
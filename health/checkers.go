@@ -0,0 +1,48 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Ping checks the database connection
+func Ping(db *sql.DB) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if db == nil {
+			return errors.New("not initialized")
+		}
+		if err := db.PingContext(ctx); err != nil {
+			return fmt.Errorf("db.Ping: %s", err.Error())
+		}
+		return nil
+	})
+}
+
+// ConnectedFunc is up while connected returns true
+func ConnectedFunc(connected func() bool) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if !connected() {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+}
+
+// Connected is up while the connected gauge is set
+func Connected(g prometheus.Gauge) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		var m dto.Metric
+		if err := g.Write(&m); err != nil {
+			return fmt.Errorf("gauge.Write: %s", err.Error())
+		}
+		if m.GetGauge().GetValue() <= 0 {
+			return errors.New("not connected")
+		}
+		return nil
+	})
+}
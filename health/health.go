@@ -0,0 +1,237 @@
+package health
+
+// health aggregates the status of the components for the kubernetes probes.
+// the components register their checkers, the critical ones fail the probes:
+// /readyz returns 503 while a critical component is down,
+// /healthz returns 503 when it is down longer than DownFor, so the pod is restarted
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/metrics"
+)
+
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+type Config struct {
+	Timeout int `yaml:"timeout" default:"5"`    // seconds for every check
+	DownFor int `yaml:"down_for" default:"300"` // seconds a critical component is down before the liveness fails, 0 - never
+}
+
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+type ComponentStatus struct {
+	Status    string     `json:"status"`
+	Critical  bool       `json:"critical"`
+	Error     string     `json:"error,omitempty"`
+	DownSince *time.Time `json:"down_since,omitempty"`
+	Took      string     `json:"took"`
+}
+
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+type check struct {
+	checker   Checker
+	critical  bool
+	downSince time.Time
+}
+
+type Registry struct {
+	conf   Config
+	mu     sync.Mutex
+	checks map[string]*check
+}
+
+// Default is used by the components and the package functions
+var Default = NewRegistry(Config{Timeout: 5, DownFor: 300})
+
+func NewRegistry(conf Config) *Registry {
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5
+	}
+	return &Registry{
+		conf:   conf,
+		checks: make(map[string]*check),
+	}
+}
+
+func Register(name string, critical bool, c Checker) {
+	Default.Register(name, critical, c)
+}
+
+func Unregister(name string) {
+	Default.Unregister(name)
+}
+
+func AddHandler(r *gin.Engine) {
+	Default.AddHandler(r)
+}
+
+// Register replaces the checker registered with the same name
+func (r *Registry) Register(name string, critical bool, c Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = &check{checker: c, critical: critical}
+}
+
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.checks, name)
+}
+
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.checks))
+	for name := range r.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check runs the checkers in parallel, every one within the timeout
+func (r *Registry) Check(ctx context.Context) Report {
+	r.mu.Lock()
+	checks := make(map[string]*check, len(r.checks))
+	for name, c := range r.checks {
+		checks[name] = c
+	}
+	r.mu.Unlock()
+
+	type result struct {
+		name string
+		err  error
+		took time.Duration
+	}
+	results := make(chan result, len(checks))
+	for name, c := range checks {
+		go func(name string, c Checker) {
+			begin := time.Now()
+			results <- result{name: name, err: r.run(ctx, c), took: time.Since(begin)}
+		}(name, c.checker)
+	}
+
+	report := Report{
+		Status:     StatusUp,
+		Components: make(map[string]ComponentStatus, len(checks)),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range checks {
+		res := <-results
+		c := checks[res.name]
+		status := ComponentStatus{
+			Status:   StatusUp,
+			Critical: c.critical,
+			Took:     res.took.String(),
+		}
+		if res.err == nil {
+			c.downSince = time.Time{}
+		} else {
+			if c.downSince.IsZero() {
+				c.downSince = time.Now()
+			}
+			downSince := c.downSince
+			status.Status = StatusDown
+			status.Error = res.err.Error()
+			status.DownSince = &downSince
+			if c.critical {
+				report.Status = StatusDown
+			}
+		}
+		report.Components[res.name] = status
+	}
+	return report
+}
+
+// run does not wait for the checker ignoring the context longer than the timeout
+func (r *Registry) run(ctx context.Context, c Checker) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(r.conf.Timeout)*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timeout: %s", ctx.Err().Error())
+	}
+}
+
+// Live is false when a critical component is down longer than DownFor
+func (r *Registry) Live(report Report) bool {
+	if r.conf.DownFor <= 0 {
+		return true
+	}
+	for _, status := range report.Components {
+		if status.Critical && status.DownSince != nil &&
+			time.Since(*status.DownSince) > time.Duration(r.conf.DownFor)*time.Second {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Registry) AddHandler(e *gin.Engine) {
+	e.GET("/healthz", metrics.Version, r.Healthz)
+	e.GET("/readyz", metrics.Version, r.Readyz)
+}
+
+// Healthz is the liveness probe
+func (r *Registry) Healthz(c *gin.Context) {
+	report := r.Check(c.Request.Context())
+	code := http.StatusOK
+	if !r.Live(report) {
+		code = http.StatusServiceUnavailable
+		log.WithField("components", down(report)).Error("health: not live")
+	}
+	c.JSON(code, report)
+}
+
+// Readyz is the readiness probe
+func (r *Registry) Readyz(c *gin.Context) {
+	report := r.Check(c.Request.Context())
+	code := http.StatusOK
+	if report.Status != StatusUp {
+		code = http.StatusServiceUnavailable
+		log.WithField("components", down(report)).Warn("health: not ready")
+	}
+	c.JSON(code, report)
+}
+
+func down(report Report) []string {
+	var names []string
+	for name, status := range report.Components {
+		if status.Status == StatusDown {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
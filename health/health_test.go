@@ -0,0 +1,146 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func up() Checker {
+	return CheckerFunc(func(ctx context.Context) error { return nil })
+}
+
+func failing() Checker {
+	return CheckerFunc(func(ctx context.Context) error { return errors.New("refused") })
+}
+
+func hanging() Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		time.Sleep(time.Hour)
+		return nil
+	})
+}
+
+func TestRegistryCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks map[string]bool // critical
+		down   map[string]Checker
+		status string
+	}{
+		{"all up", map[string]bool{"db": true, "cache": false}, nil, StatusUp},
+		{"critical down", map[string]bool{"db": true, "cache": false}, map[string]Checker{"db": failing()}, StatusDown},
+		{"not critical down", map[string]bool{"db": true, "cache": false}, map[string]Checker{"cache": failing()}, StatusUp},
+		{"timeout", map[string]bool{"db": true}, map[string]Checker{"db": hanging()}, StatusDown},
+		{"nothing registered", nil, nil, StatusUp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(Config{Timeout: 1, DownFor: 300})
+			for name, critical := range tt.checks {
+				c, ok := tt.down[name]
+				if !ok {
+					c = up()
+				}
+				r.Register(name, critical, c)
+			}
+			report := r.Check(context.Background())
+			if report.Status != tt.status {
+				t.Fatalf("status %s, want %s", report.Status, tt.status)
+			}
+			if len(report.Components) != len(tt.checks) {
+				t.Fatalf("%d components, want %d", len(report.Components), len(tt.checks))
+			}
+			for name, status := range report.Components {
+				_, isDown := tt.down[name]
+				if (status.Status == StatusDown) != isDown || (status.DownSince != nil) != isDown {
+					t.Fatalf("%s: %+v", name, status)
+				}
+				if status.Critical != tt.checks[name] {
+					t.Fatalf("%s: critical %v", name, status.Critical)
+				}
+			}
+			if !r.Live(report) {
+				t.Fatal("not live right after going down")
+			}
+		})
+	}
+}
+
+// the component stays down since the first failed check, the liveness fails after DownFor
+func TestRegistryLive(t *testing.T) {
+	r := NewRegistry(Config{Timeout: 1, DownFor: 1})
+	failed := true
+	r.Register("amqp", true, CheckerFunc(func(ctx context.Context) error {
+		if failed {
+			return errors.New("not connected")
+		}
+		return nil
+	}))
+
+	first := r.Check(context.Background())
+	since := *first.Components["amqp"].DownSince
+	time.Sleep(1100 * time.Millisecond)
+	report := r.Check(context.Background())
+	if got := *report.Components["amqp"].DownSince; !got.Equal(since) {
+		t.Fatalf("down since %s, want %s", got, since)
+	}
+	if r.Live(report) {
+		t.Fatal("live while down longer than DownFor")
+	}
+
+	failed = false
+	report = r.Check(context.Background())
+	if report.Status != StatusUp || !r.Live(report) {
+		t.Fatalf("not recovered: %+v", report)
+	}
+	if never := NewRegistry(Config{}); !never.Live(first) {
+		t.Fatal("DownFor 0 fails the liveness")
+	}
+}
+
+func TestRegistryNames(t *testing.T) {
+	r := NewRegistry(Config{})
+	r.Register("b", true, up())
+	r.Register("a", false, up())
+	r.Register("b", false, failing())
+	if got := r.Names(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("names %v", got)
+	}
+	if report := r.Check(context.Background()); report.Components["b"].Critical {
+		t.Fatal("b is not replaced")
+	}
+	r.Unregister("b")
+	r.Unregister("missing")
+	if got := r.Names(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("names after unregister %v", got)
+	}
+}
+
+func TestConnectedCheckers(t *testing.T) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "connected"})
+	connected := false
+	checkers := map[string]Checker{
+		"gauge": Connected(g),
+		"func":  ConnectedFunc(func() bool { return connected }),
+	}
+	for name, c := range checkers {
+		if err := c.Check(context.Background()); err == nil {
+			t.Fatalf("%s: up while not connected", name)
+		}
+	}
+	g.Set(1)
+	connected = true
+	for name, c := range checkers {
+		if err := c.Check(context.Background()); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+	}
+	if err := Ping(nil).Check(context.Background()); err == nil {
+		t.Fatal("nil db is up")
+	}
+}
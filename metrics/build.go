@@ -0,0 +1,121 @@
+package metrics
+
+// build metadata of the service, set at link time
+//
+//	go build -ldflags "-X github.com/linkit360/go-utils/metrics.VersionName=2.1.0
+//	    -X github.com/linkit360/go-utils/metrics.Commit=$(git rev-parse HEAD)
+//	    -X github.com/linkit360/go-utils/metrics.BuildTime=$(date -u +%FT%TZ)"
+//
+// or read from debug.ReadBuildInfo: the main module version and the vcs stamp
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// libraryVersion is the version of go-utils itself,
+// the last resort when the module version is not in the build info
+const libraryVersion = "1.8.4"
+
+const modulePath = "github.com/linkit360/go-utils"
+
+var (
+	Commit    = ""
+	BuildTime = ""
+)
+
+type BuildInfo struct {
+	Path      string `json:"path,omitempty"` // main module
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+	Library   string `json:"library"` // go-utils version the service is built with
+}
+
+var build struct {
+	once sync.Once
+	info BuildInfo
+}
+
+// Build is the link time metadata completed with the embedded build info
+func Build() BuildInfo {
+	build.once.Do(func() {
+		build.info = readBuildInfo()
+	})
+	info := build.info
+	// set by ldflags or by the service
+	if VersionName != libraryVersion {
+		info.Version = VersionName
+	}
+	return info
+}
+
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   VersionName,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+		Library:   libraryVersion,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Path = bi.Main.Path
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+		if bi.Main.Path == modulePath {
+			info.Library = bi.Main.Version
+		}
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				dep = dep.Replace
+			}
+			info.Library = dep.Version
+		}
+	}
+
+	modified := false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = s.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = s.Value
+			}
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if modified && Commit == "" && info.Commit != "" {
+		info.Commit += "-dirty"
+	}
+	return info
+}
+
+// BuildInfo sets the build_info gauge to 1 with the build metadata labels
+func (r *Registry) BuildInfo() {
+	info := Build()
+	gauge := r.PrometheusGaugeVec("", "", "build_info", "build metadata of the service",
+		[]string{"version", "commit", "build_time", "go_version", "library"})
+	gauge.Reset()
+	gauge.WithLabelValues(info.Version, info.Commit, info.BuildTime, info.GoVersion, info.Library).Set(1)
+}
+
+// AddVersionHandler serves the build metadata as json on /version
+func AddVersionHandler(r *gin.Engine) {
+	r.GET("/version", Version, func(c *gin.Context) {
+		c.JSON(http.StatusOK, Build())
+	})
+}
@@ -0,0 +1,107 @@
+package metrics
+
+// Gauge counts the events of the interval between updates, for example, db errors per minute.
+// the gauge is the count of the last window intervals, the counter keeps the total,
+// so the rate is also taken from the counter by prometheus.
+// Inc and Update are safe for concurrent use, Update is called by the Ticker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Gauge struct {
+	gauge   prometheus.Gauge
+	counter prometheus.Counter
+	mu      sync.Mutex // serializes updates
+	slots   []int64    // counts of the window intervals and of the current one
+	current int64      // index of the current slot
+}
+
+func newGauge(gauge prometheus.Gauge, counter prometheus.Counter, window int) *Gauge {
+	if window < 1 {
+		window = 1
+	}
+	return &Gauge{
+		gauge:   gauge,
+		counter: counter,
+		slots:   make([]int64, window+1),
+	}
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.slots[atomic.LoadInt64(&g.current)], n)
+	g.counter.Add(float64(n))
+}
+
+// Update closes the current interval and sets the gauge to the count of the window,
+// the oldest interval leaves the window
+func (g *Gauge) Update() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	next := (atomic.LoadInt64(&g.current) + 1) % int64(len(g.slots))
+	atomic.StoreInt64(&g.slots[next], 0)
+	atomic.StoreInt64(&g.current, next)
+
+	var sum int64
+	for i := range g.slots {
+		if int64(i) != next {
+			sum += atomic.LoadInt64(&g.slots[i])
+		}
+	}
+	g.gauge.Set(float64(sum))
+}
+
+// Ticker updates the gauges every interval until Stop
+type Ticker struct {
+	ticker *time.Ticker
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewTicker(interval time.Duration, gauges ...*Gauge) *Ticker {
+	return Every(interval, func() {
+		for _, g := range gauges {
+			g.Update()
+		}
+	})
+}
+
+// Every calls fn every interval until Stop, the calls do not overlap
+func Every(interval time.Duration, fn func()) *Ticker {
+	t := &Ticker{
+		ticker: time.NewTicker(interval),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(t.done)
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-t.ticker.C:
+				fn()
+			}
+		}
+	}()
+	return t
+}
+
+// Stop stops the ticker and waits for the running call, it must not be called from fn
+func (t *Ticker) Stop() {
+	t.once.Do(func() {
+		t.ticker.Stop()
+		close(t.stop)
+	})
+	<-t.done
+}
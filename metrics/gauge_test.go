@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestWindowGauge(t *testing.T) {
+	tests := []struct {
+		name   string
+		window int
+		incs   []int64   // added before every update
+		want   []float64 // the gauge after every update
+	}{
+		{"one interval", 1, []int64{3, 0, 2}, []float64{3, 0, 2}},
+		{"three intervals", 3, []int64{1, 2, 3, 4, 0, 0, 0}, []float64{1, 3, 6, 9, 7, 4, 0}},
+		{"window below one", 0, []int64{5, 1}, []float64{5, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(NewTestRegistry())
+			g := r.NewWindowGauge("test", "", "errors", "errors", nil, tt.window)
+			var total int64
+			for i, n := range tt.incs {
+				g.Add(n)
+				total += n
+				g.Update()
+				if got := gaugeValue(t, g.gauge); got != tt.want[i] {
+					t.Fatalf("update %d: gauge %v, want %v", i, got, tt.want[i])
+				}
+			}
+			if got := counterValue(t, g.counter); got != float64(total) {
+				t.Fatalf("counter %v, want %d", got, total)
+			}
+		})
+	}
+}
+
+// the increments racing the update are counted in one of the intervals
+func TestWindowGaugeConcurrent(t *testing.T) {
+	r := NewRegistry(NewTestRegistry())
+	g := r.NewWindowGauge("test", "", "events", "events", nil, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				g.Inc()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		g.Update()
+	}
+	wg.Wait()
+	g.Update()
+	if got := gaugeValue(t, g.gauge); got != 4000 {
+		t.Fatalf("gauge %v, want 4000", got)
+	}
+}
+
+func TestEveryStop(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	ticker := Every(time.Millisecond, func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+	time.Sleep(20 * time.Millisecond)
+	ticker.Stop()
+	mu.Lock()
+	stopped := calls
+	mu.Unlock()
+	if stopped == 0 {
+		t.Fatal("fn is not called")
+	}
+	time.Sleep(10 * time.Millisecond)
+	ticker.Stop()
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != stopped {
+		t.Fatalf("fn is called after Stop: %d, %d", calls, stopped)
+	}
+}
@@ -3,74 +3,85 @@ package metrics
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var VersionName = "1.8.4"
+// VersionName is the service version in the build info and on /version, set by ldflags or by the service
+var VersionName = libraryVersion
+
+// LatencyBuckets are seconds from 1ms to 30s for the db queries, the http and amqp calls
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// SummaryObjectives are the median, 90th and 99th percentiles
+var SummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 
 func AddHandler(r *gin.Engine) {
+	DefaultRegistry.BuildInfo()
 	_ = r.Group("/metrics").GET("", Version, gin.WrapH(prometheus.Handler()))
 	_ = r.Group("/metrics").HEAD("", Version) // for bot online
 }
 
-func Version(c *gin.Context) {
-	c.Header("X-Version", VersionName)
-}
-
-type Gauge struct {
-	gauge   prometheus.Gauge
-	counter int64
+// AddGathererHandler serves the metrics of the own registry,
+// the build info is registered with reg, g gathers the metrics of reg
+func AddGathererHandler(r *gin.Engine, reg *Registry, g prometheus.Gatherer) {
+	reg.BuildInfo()
+	_ = r.Group("/metrics").GET("", Version, gin.WrapH(promhttp.HandlerFor(g, promhttp.HandlerOpts{})))
+	_ = r.Group("/metrics").HEAD("", Version) // for bot online
 }
 
-func (g *Gauge) Inc() {
-	g.counter++
+// Version sends the go-utils version in X-Version as before and the service version in X-Service-Version
+func Version(c *gin.Context) {
+	info := Build()
+	c.Header("X-Version", info.Library)
+	c.Header("X-Service-Version", info.Version)
 }
 
-func (g *Gauge) Update() {
-	g.gauge.Set(float64(g.counter))
-	g.counter = 0
+func NewGauge(namespace, subsystem, name, help string) *Gauge {
+	return DefaultRegistry.NewGauge(namespace, subsystem, name, help)
 }
-
-func NewGauge(namespace, subsystem, name, help string) Gauge {
-	g := Gauge{}
-	g.gauge = PrometheusGauge(namespace, subsystem, name, help)
-	return g
+func NewGaugeLabel(namespace, subsystem, name, help string, labels map[string]string) *Gauge {
+	return DefaultRegistry.NewGaugeLabel(namespace, subsystem, name, help, labels)
 }
-func NewGaugeLabel(namespace, subsystem, name, help string, labels map[string]string) Gauge {
-	g := Gauge{}
-	g.gauge = PrometheusGaugeLabel(namespace, subsystem, name, help, labels)
-	return g
+func NewWindowGauge(namespace, subsystem, name, help string, window int) *Gauge {
+	return DefaultRegistry.NewWindowGauge(namespace, subsystem, name, help, nil, window)
 }
 func PrometheusGauge(namespace, subsystem, name, help string) prometheus.Gauge {
-	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Subsystem: subsystem,
-		Name:      name,
-		Help:      help,
-	})
-	prometheus.MustRegister(gauge)
-	return gauge
+	return DefaultRegistry.PrometheusGauge(namespace, subsystem, name, help)
 }
 
 func PrometheusGaugeLabel(namespace, subsystem, name, help string, labels map[string]string) prometheus.Gauge {
-	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace:   namespace,
-		Subsystem:   subsystem,
-		Name:        name,
-		Help:        help,
-		ConstLabels: labels,
-	})
-	prometheus.MustRegister(gauge)
-	return gauge
+	return DefaultRegistry.PrometheusGaugeLabel(namespace, subsystem, name, help, labels)
 }
 
 // for duration
 func NewSummary(name, help string) prometheus.Summary {
-	summary := prometheus.NewSummary(
-		prometheus.SummaryOpts{
-			Name: name,
-			Help: help,
-		},
-	)
-	prometheus.MustRegister(summary)
-	return summary
+	return DefaultRegistry.NewSummary(name, help)
+}
+
+func PrometheusCounter(namespace, subsystem, name, help string) prometheus.Counter {
+	return DefaultRegistry.PrometheusCounter(namespace, subsystem, name, help)
+}
+
+func PrometheusCounterVec(namespace, subsystem, name, help string, labels []string) *prometheus.CounterVec {
+	return DefaultRegistry.PrometheusCounterVec(namespace, subsystem, name, help, labels)
+}
+
+func PrometheusHistogram(namespace, subsystem, name, help string, buckets []float64) prometheus.Histogram {
+	return DefaultRegistry.PrometheusHistogram(namespace, subsystem, name, help, buckets)
+}
+
+func PrometheusHistogramVec(namespace, subsystem, name, help string, buckets []float64, labels []string) *prometheus.HistogramVec {
+	return DefaultRegistry.PrometheusHistogramVec(namespace, subsystem, name, help, buckets, labels)
+}
+
+func PrometheusSummary(namespace, subsystem, name, help string) prometheus.Summary {
+	return DefaultRegistry.PrometheusSummary(namespace, subsystem, name, help)
+}
+
+func PrometheusSummaryVec(namespace, subsystem, name, help string, labels []string) *prometheus.SummaryVec {
+	return DefaultRegistry.PrometheusSummaryVec(namespace, subsystem, name, help, labels)
+}
+
+func PrometheusGaugeVec(namespace, subsystem, name, help string, labels []string) *prometheus.GaugeVec {
+	return DefaultRegistry.PrometheusGaugeVec(namespace, subsystem, name, help, labels)
 }
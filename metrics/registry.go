@@ -0,0 +1,179 @@
+package metrics
+
+// the collectors are registered to the registerer given to the component,
+// the collector already registered with the same description is reused,
+// so two components with the same metric names share it instead of panic
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Registry struct {
+	reg prometheus.Registerer
+}
+
+// DefaultRegistry is used by the package functions
+var DefaultRegistry = NewRegistry(nil)
+
+// NewRegistry wraps the registerer, nil is prometheus.DefaultRegisterer
+func NewRegistry(reg prometheus.Registerer) *Registry {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return &Registry{reg: reg}
+}
+
+// NewTestRegistry is the registry of one component under test,
+// pass it as the registerer and gather it in the test
+func NewTestRegistry() *prometheus.Registry {
+	return prometheus.NewPedanticRegistry()
+}
+
+// Registerer is passed to the components of the same registry
+func (r *Registry) Registerer() prometheus.Registerer {
+	return r.reg
+}
+
+// Register returns the registered collector or the existing one with the same description,
+// the other registration errors panic as prometheus.MustRegister does
+func (r *Registry) Register(c prometheus.Collector) prometheus.Collector {
+	if err := r.reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+func (r *Registry) NewGauge(namespace, subsystem, name, help string) *Gauge {
+	return r.NewWindowGauge(namespace, subsystem, name, help, nil, 1)
+}
+
+func (r *Registry) NewGaugeLabel(namespace, subsystem, name, help string, labels map[string]string) *Gauge {
+	return r.NewWindowGauge(namespace, subsystem, name, help, labels, 1)
+}
+
+// NewWindowGauge is the count of the last window updates and the name_total counter
+func (r *Registry) NewWindowGauge(namespace, subsystem, name, help string, labels map[string]string, window int) *Gauge {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name + "_total",
+		Help:        help + ", total",
+		ConstLabels: labels,
+	})
+	return newGauge(
+		r.PrometheusGaugeLabel(namespace, subsystem, name, help, labels),
+		r.Register(counter).(prometheus.Counter),
+		window,
+	)
+}
+
+func (r *Registry) PrometheusGauge(namespace, subsystem, name, help string) prometheus.Gauge {
+	return r.PrometheusGaugeLabel(namespace, subsystem, name, help, nil)
+}
+
+func (r *Registry) PrometheusGaugeLabel(namespace, subsystem, name, help string, labels map[string]string) prometheus.Gauge {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: labels,
+	})
+	return r.Register(gauge).(prometheus.Gauge)
+}
+
+// for duration
+func (r *Registry) NewSummary(name, help string) prometheus.Summary {
+	summary := prometheus.NewSummary(
+		prometheus.SummaryOpts{
+			Name: name,
+			Help: help,
+		},
+	)
+	return r.Register(summary).(prometheus.Summary)
+}
+
+func (r *Registry) PrometheusCounter(namespace, subsystem, name, help string) prometheus.Counter {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	})
+	return r.Register(counter).(prometheus.Counter)
+}
+
+func (r *Registry) PrometheusCounterVec(namespace, subsystem, name, help string, labels []string) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	return r.Register(counter).(*prometheus.CounterVec)
+}
+
+// PrometheusHistogram uses LatencyBuckets if buckets are nil
+func (r *Registry) PrometheusHistogram(namespace, subsystem, name, help string, buckets []float64) prometheus.Histogram {
+	if buckets == nil {
+		buckets = LatencyBuckets
+	}
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	})
+	return r.Register(histogram).(prometheus.Histogram)
+}
+
+// PrometheusHistogramVec uses LatencyBuckets if buckets are nil
+func (r *Registry) PrometheusHistogramVec(namespace, subsystem, name, help string, buckets []float64, labels []string) *prometheus.HistogramVec {
+	if buckets == nil {
+		buckets = LatencyBuckets
+	}
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, labels)
+	return r.Register(histogram).(*prometheus.HistogramVec)
+}
+
+func (r *Registry) PrometheusSummary(namespace, subsystem, name, help string) prometheus.Summary {
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       name,
+		Help:       help,
+		Objectives: SummaryObjectives,
+	})
+	return r.Register(summary).(prometheus.Summary)
+}
+
+func (r *Registry) PrometheusSummaryVec(namespace, subsystem, name, help string, labels []string) *prometheus.SummaryVec {
+	summary := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       name,
+		Help:       help,
+		Objectives: SummaryObjectives,
+	}, labels)
+	return r.Register(summary).(*prometheus.SummaryVec)
+}
+
+func (r *Registry) PrometheusGaugeVec(namespace, subsystem, name, help string, labels []string) *prometheus.GaugeVec {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	return r.Register(gauge).(*prometheus.GaugeVec)
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Timer observes the seconds since it was created,
+//
+//	t := metrics.NewTimer(queryDuration.WithLabelValues("get_retries"))
+//	defer t.ObserveDuration()
+type Timer struct {
+	begin     time.Time
+	observers []prometheus.Observer
+}
+
+func NewTimer(observers ...prometheus.Observer) *Timer {
+	return &Timer{
+		begin:     time.Now(),
+		observers: observers,
+	}
+}
+
+// Took is the time since the timer was created, for the logs
+func (t *Timer) Took() time.Duration {
+	return time.Since(t.begin)
+}
+
+// ObserveDuration observes the seconds to every observer and returns the duration
+func (t *Timer) ObserveDuration() time.Duration {
+	took := time.Since(t.begin)
+	for _, o := range t.observers {
+		o.Observe(took.Seconds())
+	}
+	return took
+}
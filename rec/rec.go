@@ -1,6 +1,7 @@
 package rec
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
@@ -12,11 +13,13 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/linkit360/go-utils/db"
+	"github.com/linkit360/go-utils/health"
 	m "github.com/linkit360/go-utils/metrics"
 )
 
 // please, do not add any json named field in old field,
-// bcz unmarshalling will brake the flow
+// bcz unmarshalling will brake the flow,
+// register the new version of the event in envelope package instead
 type Record struct {
 	Type                     string    `json:"type,omitempty"`
 	Msisdn                   string    `json:"msisdn,omitempty"`
@@ -71,25 +74,33 @@ func (r Record) TransactionOnly() bool {
 
 var dbConn *sql.DB
 var conf db.DataBaseConfig
-var DBErrors m.Gauge
-var Warn m.Gauge
+var DBErrors *m.Gauge
+var Warn *m.Gauge
+var gaugeTicker *m.Ticker
 var AddNewSubscriptionDuration prometheus.Summary
+var QueryDuration *prometheus.HistogramVec
 
 func Init(dbC db.DataBaseConfig) {
+	InitWithRegisterer(dbC, nil)
+}
+
+// InitWithRegisterer registers the metrics to the registerer, nil is the default one
+func InitWithRegisterer(dbC db.DataBaseConfig, reg prometheus.Registerer) {
 	log.SetLevel(log.DebugLevel)
 	dbConn = db.Init(dbC)
 	conf = dbC
+	health.Register("db", true, health.Ping(dbConn))
 
-	DBErrors = m.NewGauge("", "", "db_errors", "DB errors overall")
-	Warn = m.NewGauge("", "", "warnings", "warnings overall")
-	go func() {
-		for range time.Tick(time.Minute) {
-			DBErrors.Update()
-			Warn.Update()
-		}
-	}()
+	r := m.NewRegistry(reg)
+	DBErrors = r.NewGauge("", "", "db_errors", "DB errors overall")
+	Warn = r.NewGauge("", "", "warnings", "warnings overall")
+	if gaugeTicker != nil {
+		gaugeTicker.Stop()
+	}
+	gaugeTicker = m.NewTicker(time.Minute, DBErrors, Warn)
 
-	AddNewSubscriptionDuration = m.NewSummary("subscription_add_to_db_duration_seconds", "new subscription add duration")
+	AddNewSubscriptionDuration = r.NewSummary("subscription_add_to_db_duration_seconds", "new subscription add duration")
+	QueryDuration = r.PrometheusHistogramVec("rec", "", "query_duration_seconds", "rec query duration", nil, []string{"query"})
 }
 
 // msisdn - service code - campaign id
@@ -104,14 +115,19 @@ func GenerateTID(optional ...string) string {
 }
 
 func GetRetryTransactions(operatorCode int64, batchLimit int, paidOnceHours int) ([]Record, error) {
-	begin := time.Now()
+	return GetRetryTransactionsContext(context.Background(), operatorCode, batchLimit, paidOnceHours)
+}
+
+func GetRetryTransactionsContext(ctx context.Context, operatorCode int64, batchLimit int, paidOnceHours int) ([]Record, error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetRetryTransactions"))
+	defer timer.ObserveDuration()
 	var retries []Record
 	var err error
 	var query string
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":          time.Since(begin),
+				"took":          timer.Took(),
 				"operator_code": operatorCode,
 				"limit":         batchLimit,
 				"query":         query,
@@ -162,7 +178,7 @@ func GetRetryTransactions(operatorCode int64, batchLimit int, paidOnceHours int)
 		strconv.Itoa(batchLimit),
 	)
 
-	rows, err := dbConn.Query(query, operatorCode)
+	rows, err := tracedQuery(ctx, "GetRetryTransactions", query, operatorCode)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -205,16 +221,21 @@ func GetRetryTransactions(operatorCode int64, batchLimit int, paidOnceHours int)
 }
 
 func SetSubscriptionStatus(status string, id int64) (err error) {
+	return SetSubscriptionStatusContext(context.Background(), status, id)
+}
+
+func SetSubscriptionStatusContext(ctx context.Context, status string, id int64) (err error) {
 	if id == 0 {
 		log.WithFields(log.Fields{"error": "no subscription id"}).Error("set periodic status")
 		return nil
 	}
-	begin := time.Now()
+	timer := m.NewTimer(QueryDuration.WithLabelValues("SetSubscriptionStatus"))
+	defer timer.ObserveDuration()
 	defer func() {
 		fields := log.Fields{
 			"status":          status,
 			"subscription_id": id,
-			"took":            time.Since(begin),
+			"took":            timer.Took(),
 		}
 		if err != nil {
 			fields["error"] = err.Error()
@@ -232,7 +253,7 @@ func SetSubscriptionStatus(status string, id int64) (err error) {
 	)
 
 	updatedAt := time.Now().UTC()
-	_, err = dbConn.Exec(query, status, updatedAt, id)
+	_, err = tracedExec(ctx, "SetSubscriptionStatus", query, status, updatedAt, id)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -242,16 +263,21 @@ func SetSubscriptionStatus(status string, id int64) (err error) {
 	return nil
 }
 func SetRetryStatus(status string, id int64) (err error) {
+	return SetRetryStatusContext(context.Background(), status, id)
+}
+
+func SetRetryStatusContext(ctx context.Context, status string, id int64) (err error) {
 	if id == 0 {
 		log.WithFields(log.Fields{"error": "no retry id"}).Error("set retry status")
 		return nil
 	}
-	begin := time.Now()
+	timer := m.NewTimer(QueryDuration.WithLabelValues("SetRetryStatus"))
+	defer timer.ObserveDuration()
 	defer func() {
 		fields := log.Fields{
 			"status": status,
 			"id":     id,
-			"took":   time.Since(begin),
+			"took":   timer.Took(),
 		}
 		if err != nil {
 			fields["error"] = err.Error()
@@ -267,7 +293,7 @@ func SetRetryStatus(status string, id int64) (err error) {
 		"WHERE id = $3", conf.TablePrefix)
 
 	updatedAt := time.Now().UTC()
-	_, err = dbConn.Exec(query, status, updatedAt, id)
+	_, err = tracedExec(ctx, "SetRetryStatus", query, status, updatedAt, id)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -277,13 +303,18 @@ func SetRetryStatus(status string, id int64) (err error) {
 	return nil
 }
 func LoadScriptRetries(hoursPassed int, operatorCode int64, batchLimit int) (records []Record, err error) {
+	return LoadScriptRetriesContext(context.Background(), hoursPassed, operatorCode, batchLimit)
+}
+
+func LoadScriptRetriesContext(ctx context.Context, hoursPassed int, operatorCode int64, batchLimit int) (records []Record, err error) {
 	var retries []Record
 	query := ""
-	begin := time.Now()
+	timer := m.NewTimer(QueryDuration.WithLabelValues("LoadScriptRetries"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":  time.Since(begin),
+				"took":  timer.Took(),
 				"hours": hoursPassed,
 				"limit": batchLimit,
 			}
@@ -320,7 +351,7 @@ func LoadScriptRetries(hoursPassed int, operatorCode int64, batchLimit int) (rec
 		conf.TablePrefix,
 		strconv.Itoa(batchLimit),
 	)
-	rows, err := dbConn.Query(query, operatorCode)
+	rows, err := tracedQuery(ctx, "LoadScriptRetries", query, operatorCode)
 	if err != nil {
 		DBErrors.Inc()
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
@@ -374,11 +405,16 @@ type ActiveSubscription struct {
 }
 
 func LoadActiveSubscriptions() (records []ActiveSubscription, err error) {
-	begin := time.Now()
+	return LoadActiveSubscriptionsContext(context.Background())
+}
+
+func LoadActiveSubscriptionsContext(ctx context.Context) (records []ActiveSubscription, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("LoadActiveSubscriptions"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took": time.Since(begin),
+				"took": timer.Took(),
 			}
 			if err != nil {
 				fields["error"] = err.Error()
@@ -406,7 +442,7 @@ func LoadActiveSubscriptions() (records []ActiveSubscription, err error) {
 	)
 
 	prev := []ActiveSubscription{}
-	rows, err := dbConn.Query(query)
+	rows, err := tracedQuery(ctx, "LoadActiveSubscriptions", query)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -452,14 +488,19 @@ type HistoryCache struct {
 }
 
 func GetCountOfFailedChargesFor(msisdn, tid string, subscriptionId int64, lastDays int) (count int, err error) {
-	begin := time.Now()
+	return GetCountOfFailedChargesForContext(context.Background(), msisdn, tid, subscriptionId, lastDays)
+}
+
+func GetCountOfFailedChargesForContext(ctx context.Context, msisdn, tid string, subscriptionId int64, lastDays int) (count int, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetCountOfFailedChargesFor"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
 				"subscription_id": subscriptionId,
 				"msisdn":          msisdn,
 				"tid":             tid,
-				"took":            time.Since(begin),
+				"took":            timer.Took(),
 			}
 			if err != nil {
 				fields["error"] = err.Error()
@@ -479,7 +520,7 @@ func GetCountOfFailedChargesFor(msisdn, tid string, subscriptionId int64, lastDa
 		lastDays,
 	)
 
-	if err = dbConn.QueryRow(query, msisdn, subscriptionId).Scan(&count); err != nil {
+	if err = tracedQueryRow(ctx, "GetCountOfFailedChargesFor", query, msisdn, subscriptionId).Scan(&count); err != nil {
 		DBErrors.Inc()
 
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
@@ -490,11 +531,16 @@ func GetCountOfFailedChargesFor(msisdn, tid string, subscriptionId int64, lastDa
 }
 
 func GetCountOfDownloadedContent(subscriptionId int64) (count int, err error) {
-	begin := time.Now()
+	return GetCountOfDownloadedContentContext(context.Background(), subscriptionId)
+}
+
+func GetCountOfDownloadedContentContext(ctx context.Context, subscriptionId int64) (count int, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetCountOfDownloadedContent"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took": time.Since(begin),
+				"took": timer.Took(),
 			}
 			if err != nil {
 				fields["error"] = err.Error()
@@ -511,7 +557,7 @@ func GetCountOfDownloadedContent(subscriptionId int64) (count int, err error) {
 		conf.TablePrefix,
 	)
 
-	if err = dbConn.QueryRow(query, subscriptionId).Scan(&count); err != nil {
+	if err = tracedQueryRow(ctx, "GetCountOfDownloadedContent", query, subscriptionId).Scan(&count); err != nil {
 		if err == sql.ErrNoRows {
 			return 0, nil
 		}
@@ -524,6 +570,10 @@ func GetCountOfDownloadedContent(subscriptionId int64) (count int, err error) {
 }
 
 func AddNewSubscriptionToDB(r *Record) error {
+	return AddNewSubscriptionToDBContext(context.Background(), r)
+}
+
+func AddNewSubscriptionToDBContext(ctx context.Context, r *Record) error {
 	if r.SubscriptionId > 0 {
 		log.WithFields(log.Fields{
 			"tid":    r.Tid,
@@ -584,7 +634,8 @@ func AddNewSubscriptionToDB(r *Record) error {
 		}).Warn("no country code")
 		Warn.Inc()
 	}
-	begin := time.Now()
+	timer := m.NewTimer(QueryDuration.WithLabelValues("AddNewSubscriptionToDB"))
+	defer timer.ObserveDuration()
 	query := fmt.Sprintf("INSERT INTO %ssubscriptions ( "+
 		"sent_at, "+
 		"result, "+
@@ -613,7 +664,7 @@ func AddNewSubscriptionToDB(r *Record) error {
 		conf.TablePrefix,
 	)
 
-	if err := dbConn.QueryRow(query,
+	if err := tracedQueryRow(ctx, "AddNewSubscriptionToDB", query,
 		r.SentAt,
 		"",
 		r.CampaignId,
@@ -647,25 +698,30 @@ func AddNewSubscriptionToDB(r *Record) error {
 		}).Error("add new subscription")
 		return err
 	}
-	AddNewSubscriptionDuration.Observe(time.Since(begin).Seconds())
+	AddNewSubscriptionDuration.Observe(timer.Took().Seconds())
 	log.WithFields(log.Fields{
 		"tid":         r.Tid,
 		"id":          r.SubscriptionId,
 		"service_id":  r.ServiceCode,
 		"campaign_id": r.CampaignId,
-		"took":        time.Since(begin).Seconds(),
+		"took":        timer.Took().Seconds(),
 	}).Info("added new subscription")
 	return nil
 }
 
 // bare periodic for spectfic allowed time
 func GetPeriodicsSpecificTime(batchLimit, repeaIntervalMinutes int, intervalType string, loc *time.Location) (records []Record, err error) {
-	begin := time.Now()
+	return GetPeriodicsSpecificTimeContext(context.Background(), batchLimit, repeaIntervalMinutes, intervalType, loc)
+}
+
+func GetPeriodicsSpecificTimeContext(ctx context.Context, batchLimit, repeaIntervalMinutes int, intervalType string, loc *time.Location) (records []Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetPeriodicsSpecificTime"))
+	defer timer.ObserveDuration()
 	query := ""
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":         time.Since(begin),
+				"took":         timer.Took(),
 				"intervalType": intervalType,
 				"loc":          loc.String(),
 				"query":        query,
@@ -735,7 +791,7 @@ func GetPeriodicsSpecificTime(batchLimit, repeaIntervalMinutes int, intervalType
 		batchLimit,
 	)
 
-	rows, err := dbConn.Query(query)
+	rows, err := tracedQuery(ctx, "GetPeriodicsSpecificTime", query)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -779,12 +835,17 @@ func GetPeriodicsSpecificTime(batchLimit, repeaIntervalMinutes int, intervalType
 // get periodic for today to be paid
 // with trial expired
 func GetPeriodicsOnceADay(batchLimit int) (records []Record, err error) {
-	begin := time.Now()
+	return GetPeriodicsOnceADayContext(context.Background(), batchLimit)
+}
+
+func GetPeriodicsOnceADayContext(ctx context.Context, batchLimit int) (records []Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetPeriodicsOnceADay"))
+	defer timer.ObserveDuration()
 	query := ""
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":  time.Since(begin),
+				"took":  timer.Took(),
 				"query": query,
 			}
 			if err != nil {
@@ -833,7 +894,7 @@ func GetPeriodicsOnceADay(batchLimit int) (records []Record, err error) {
 		batchLimit,
 	)
 
-	rows, err := dbConn.Query(query)
+	rows, err := tracedQuery(ctx, "GetPeriodicsOnceADay", query)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -879,12 +940,17 @@ func GetPeriodicsOnceADay(batchLimit int) (records []Record, err error) {
 // all periodic not paid, not cancelled
 // with trial expired
 func GetNotPaidPeriodics(batchLimit int) (records []Record, err error) {
-	begin := time.Now()
+	return GetNotPaidPeriodicsContext(context.Background(), batchLimit)
+}
+
+func GetNotPaidPeriodicsContext(ctx context.Context, batchLimit int) (records []Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetNotPaidPeriodics"))
+	defer timer.ObserveDuration()
 	query := ""
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took": time.Since(begin),
+				"took": timer.Took(),
 			}
 			if err != nil {
 				fields["query"] = query
@@ -925,7 +991,7 @@ func GetNotPaidPeriodics(batchLimit int) (records []Record, err error) {
 		strconv.Itoa(batchLimit),
 	)
 
-	rows, err := dbConn.Query(query)
+	rows, err := tracedQuery(ctx, "GetNotPaidPeriodics", query)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -968,12 +1034,17 @@ func GetNotPaidPeriodics(batchLimit int) (records []Record, err error) {
 
 // get some periodics to send some content
 func GetLiveTodayPeriodicsForContent(batchLimit int) (records []Record, err error) {
-	begin := time.Now()
+	return GetLiveTodayPeriodicsForContentContext(context.Background(), batchLimit)
+}
+
+func GetLiveTodayPeriodicsForContentContext(ctx context.Context, batchLimit int) (records []Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetLiveTodayPeriodicsForContent"))
+	defer timer.ObserveDuration()
 	query := ""
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":  time.Since(begin),
+				"took":  timer.Took(),
 				"query": query,
 			}
 			if err != nil {
@@ -1028,7 +1099,7 @@ func GetLiveTodayPeriodicsForContent(batchLimit int) (records []Record, err erro
 	)
 
 	var rows *sql.Rows
-	rows, err = dbConn.Query(query)
+	rows, err = tracedQuery(ctx, "GetLiveTodayPeriodicsForContent", query)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -1067,11 +1138,16 @@ func GetLiveTodayPeriodicsForContent(batchLimit int) (records []Record, err erro
 }
 
 func GetSubscriptionByToken(token string) (p Record, err error) {
-	begin := time.Now()
+	return GetSubscriptionByTokenContext(context.Background(), token)
+}
+
+func GetSubscriptionByTokenContext(ctx context.Context, token string) (p Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetSubscriptionByToken"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":  time.Since(begin),
+				"took":  timer.Took(),
 				"token": token,
 			}
 			if err != nil {
@@ -1103,7 +1179,7 @@ func GetSubscriptionByToken(token string) (p Record, err error) {
 	)
 
 	var rows *sql.Rows
-	rows, err = dbConn.Query(query, token)
+	rows, err = tracedQuery(ctx, "GetSubscriptionByToken", query, token)
 	if err != nil {
 		DBErrors.Inc()
 
@@ -1142,11 +1218,16 @@ func GetSubscriptionByToken(token string) (p Record, err error) {
 }
 
 func GetSubscriptionByMsisdn(msisdn string) (p Record, err error) {
-	begin := time.Now()
+	return GetSubscriptionByMsisdnContext(context.Background(), msisdn)
+}
+
+func GetSubscriptionByMsisdnContext(ctx context.Context, msisdn string) (p Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetSubscriptionByMsisdn"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
-				"took":   time.Since(begin),
+				"took":   timer.Took(),
 				"msisdn": msisdn,
 			}
 			if err != nil {
@@ -1182,7 +1263,7 @@ func GetSubscriptionByMsisdn(msisdn string) (p Record, err error) {
 		conf.TablePrefix,
 	)
 
-	if err = dbConn.QueryRow(query, msisdn).Scan(
+	if err = tracedQueryRow(ctx, "GetSubscriptionByMsisdn", query, msisdn).Scan(
 		&p.SubscriptionId,
 		&p.SentAt,
 		&p.Tid,
@@ -1211,12 +1292,17 @@ func GetSubscriptionByMsisdn(msisdn string) (p Record, err error) {
 }
 
 func GetRetryByMsisdn(msisdn, status string) (r Record, err error) {
-	begin := time.Now()
+	return GetRetryByMsisdnContext(context.Background(), msisdn, status)
+}
+
+func GetRetryByMsisdnContext(ctx context.Context, msisdn, status string) (r Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetRetryByMsisdn"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
 				"msisdn": msisdn,
-				"took":   time.Since(begin),
+				"took":   timer.Took(),
 			}
 			if err != nil {
 				fields["error"] = err.Error()
@@ -1252,7 +1338,7 @@ func GetRetryByMsisdn(msisdn, status string) (r Record, err error) {
 		conf.TablePrefix,
 	)
 
-	if err = dbConn.QueryRow(query, msisdn, status).Scan(
+	if err = tracedQueryRow(ctx, "GetRetryByMsisdn", query, msisdn, status).Scan(
 		&r.Msisdn,
 		&r.RetryId,
 		&r.Tid,
@@ -1279,12 +1365,17 @@ func GetRetryByMsisdn(msisdn, status string) (r Record, err error) {
 }
 
 func GetBufferPixelByCampaignCode(campaigCode string) (r Record, err error) {
-	begin := time.Now()
+	return GetBufferPixelByCampaignCodeContext(context.Background(), campaigCode)
+}
+
+func GetBufferPixelByCampaignCodeContext(ctx context.Context, campaigCode string) (r Record, err error) {
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetBufferPixelByCampaignCode"))
+	defer timer.ObserveDuration()
 	defer func() {
 		defer func() {
 			fields := log.Fields{
 				"campaign_code": campaigCode,
-				"took":          time.Since(begin),
+				"took":          timer.Took(),
 				"tid":           r.Tid,
 			}
 			if err != nil {
@@ -1314,7 +1405,7 @@ func GetBufferPixelByCampaignCode(campaigCode string) (r Record, err error) {
 		conf.TablePrefix,
 	)
 
-	if err = dbConn.QueryRow(query, campaigCode).Scan(
+	if err = tracedQueryRow(ctx, "GetBufferPixelByCampaignCode", query, campaigCode).Scan(
 		&r.SentAt,
 		&r.ServiceCode,
 		&r.CampaignId,
@@ -1332,6 +1423,10 @@ func GetBufferPixelByCampaignCode(campaigCode string) (r Record, err error) {
 }
 
 func GetNotSentPixels(hours, limit int) (records []Record, err error) {
+	return GetNotSentPixelsContext(context.Background(), hours, limit)
+}
+
+func GetNotSentPixelsContext(ctx context.Context, hours, limit int) (records []Record, err error) {
 	defer func() {
 		defer func() {
 			fields := log.Fields{
@@ -1348,10 +1443,11 @@ func GetNotSentPixels(hours, limit int) (records []Record, err error) {
 		}()
 	}()
 
-	begin := time.Now()
+	timer := m.NewTimer(QueryDuration.WithLabelValues("GetNotSentPixels"))
+	defer timer.ObserveDuration()
 	defer func() {
 		log.WithFields(log.Fields{
-			"took": time.Since(begin),
+			"took": timer.Took(),
 		}).Debug("get pixels")
 	}()
 	query := fmt.Sprintf("SELECT "+
@@ -1375,7 +1471,7 @@ func GetNotSentPixels(hours, limit int) (records []Record, err error) {
 	}
 	query = query + fmt.Sprintf(" ORDER BY id ASC LIMIT %d", limit)
 
-	rows, err := dbConn.Query(query)
+	rows, err := tracedQuery(ctx, "GetNotSentPixels", query)
 	if err != nil {
 		err = fmt.Errorf("db.Query: %s, query: %s", err.Error(), query)
 		return
@@ -0,0 +1,68 @@
+package rec
+
+// every query runs in the span of the rec function,
+// the Context functions continue the trace of ctx, the others start the new one
+
+import (
+	"context"
+	"database/sql"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/linkit360/go-utils/rec")
+
+func startQuery(ctx context.Context, name, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "rec."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.namespace", conf.Name),
+			attribute.String("db.query.text", query),
+		),
+	)
+}
+
+func endQuery(span trace.Span, err error) {
+	if err == sql.ErrNoRows {
+		span.SetAttributes(attribute.Bool("db.no_rows", true))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func tracedQuery(ctx context.Context, name, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, name, query)
+	rows, err := dbConn.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func tracedExec(ctx context.Context, name, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuery(ctx, name, query)
+	res, err := dbConn.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+// tracedRow ends the span on Scan, the query error is returned by Scan
+type tracedRow struct {
+	row  *sql.Row
+	span trace.Span
+}
+
+func tracedQueryRow(ctx context.Context, name, query string, args ...interface{}) *tracedRow {
+	ctx, span := startQuery(ctx, name, query)
+	return &tracedRow{row: dbConn.QueryRowContext(ctx, query, args...), span: span}
+}
+
+func (r *tracedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	endQuery(r.span, err)
+	return err
+}
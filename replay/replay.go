@@ -0,0 +1,414 @@
+package replay
+
+// replayer re-drives the archived messages through the notifier.
+// it reads json lines of the admin dump (amqp.DumpedMessage),
+// of the tap archive (amqp.TapRecord, gzipped, only the published records),
+// of the notifier outbox (amqp.AMQPMessage) and of bare EventNotify.
+// the message id is kept or derived from the file line,
+// so the deduplicating consumers drop the messages replayed twice
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/linkit360/go-utils/amqp"
+)
+
+type Config struct {
+	Queue           string    `yaml:"queue"`                          // target queue, required for EventNotify lines
+	Rate            int       `yaml:"rate" default:"100"`             // messages per second, 0 - unlimited
+	DryRun          bool      `yaml:"dry_run" default:"false"`        // count and log, do not publish
+	Checkpoint      string    `yaml:"checkpoint"`                     // json file with the last replayed line of every dump, kept before the first failed line
+	CheckpointEvery int       `yaml:"checkpoint_every" default:"100"` // lines between checkpoint saves
+	EventNames      []string  `yaml:"event_names"`                    // empty - all events
+	Msisdns         []string  `yaml:"msisdns"`                        // empty - all msisdns
+	From            time.Time `yaml:"from"`                           // messages without time are skipped when set
+	To              time.Time `yaml:"to"`
+	// seconds to wait for the publisher to send the buffered messages before the checkpoint save
+	DrainTimeout int `yaml:"drain_timeout" default:"60"`
+}
+
+// Publisher is implemented by amqp.Notifier
+type Publisher interface {
+	PublishContext(ctx context.Context, msg amqp.AMQPMessage) error
+	// Buffered is the count of the messages not sent to rabbit yet
+	Buffered() int
+}
+
+type Stats struct {
+	Read      int `json:"read"`
+	Resumed   int `json:"resumed"` // skipped by the checkpoint
+	Filtered  int `json:"filtered"`
+	Published int `json:"published"`
+	Failed    int `json:"failed"`
+}
+
+type Replayer struct {
+	conf       Config
+	p          Publisher
+	eventNames map[string]bool
+	msisdns    map[string]bool
+	checkpoint map[string]int
+}
+
+func New(conf Config, p Publisher) (*Replayer, error) {
+	r := &Replayer{
+		conf:       conf,
+		p:          p,
+		eventNames: set(conf.EventNames),
+		msisdns:    set(conf.Msisdns),
+		checkpoint: make(map[string]int),
+	}
+	if r.conf.CheckpointEvery <= 0 {
+		r.conf.CheckpointEvery = 1
+	}
+	if r.conf.DrainTimeout <= 0 {
+		r.conf.DrainTimeout = 60
+	}
+	if conf.Checkpoint == "" {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(conf.Checkpoint)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile: %s", err.Error())
+	}
+	if err = json.Unmarshal(data, &r.checkpoint); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: json.Unmarshal: %s", conf.Checkpoint, err.Error())
+	}
+	return r, nil
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+// Replay publishes the messages of the dump from the checkpoint till the end or ctx is done
+func (r *Replayer) Replay(ctx context.Context, path string) (stats Stats, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return stats, fmt.Errorf("filepath.Abs: %s", err.Error())
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, fmt.Errorf("os.Open: %s", err.Error())
+	}
+	defer f.Close()
+	var in io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return stats, fmt.Errorf("gzip.NewReader: %s", err.Error())
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var tick <-chan time.Time
+	if r.conf.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(r.conf.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	done := r.checkpoint[abs]
+	line := 0
+	// the checkpoint stays before the first failed line, so it is replayed on the next run,
+	// the lines after it are replayed again with the same message ids
+	failedAt := -1
+	passed := func() int {
+		if failedAt >= 0 {
+			return failedAt
+		}
+		return line
+	}
+	defer func() {
+		if saveErr := r.save(abs, passed()); saveErr != nil && err == nil {
+			err = saveErr
+		}
+		log.WithFields(log.Fields{
+			"path":      path,
+			"line":      line,
+			"read":      stats.Read,
+			"resumed":   stats.Resumed,
+			"filtered":  stats.Filtered,
+			"published": stats.Published,
+			"failed":    stats.Failed,
+			"dryRun":    r.conf.DryRun,
+		}).Info("replay done")
+	}()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			line++
+			continue
+		}
+		stats.Read++
+		if line+1 <= done {
+			line++
+			stats.Resumed++
+			continue
+		}
+
+		rec, parseErr := r.parse(abs, line+1, scanner.Bytes())
+		if parseErr != nil {
+			stats.Failed++
+			log.WithFields(log.Fields{
+				"path":  path,
+				"line":  line + 1,
+				"error": parseErr.Error(),
+			}).Error("replay: parse")
+			if failedAt < 0 {
+				failedAt = line
+			}
+			line++
+			continue
+		}
+		if rec.skip || !r.match(rec) {
+			stats.Filtered++
+			line++
+			continue
+		}
+		if rec.msg.QueueName == "" {
+			stats.Failed++
+			log.WithFields(log.Fields{
+				"path": path,
+				"line": line + 1,
+			}).Error("replay: no queue, set the target queue")
+			if failedAt < 0 {
+				failedAt = line
+			}
+			line++
+			continue
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return stats, ctx.Err()
+			}
+		}
+		if r.conf.DryRun {
+			log.WithFields(log.Fields{
+				"line":   line + 1,
+				"q":      rec.msg.QueueName,
+				"e":      rec.eventName,
+				"msisdn": rec.msisdn,
+			}).Info("replay: dry run")
+		} else if err = r.p.PublishContext(ctx, rec.msg); err != nil {
+			stats.Failed++
+			return stats, fmt.Errorf("line %d: publish: %s", line+1, err.Error())
+		}
+		stats.Published++
+		line++
+
+		if line%r.conf.CheckpointEvery == 0 {
+			if err = r.save(abs, passed()); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return stats, fmt.Errorf("scanner.Scan: %s", err.Error())
+	}
+	return stats, nil
+}
+
+// save writes the checkpoint atomically, the dry run does not move it.
+// the checkpoint moves only when the publisher has sent every buffered message,
+// so the messages lost in the buffer on crash are replayed again
+func (r *Replayer) save(abs string, line int) error {
+	if r.conf.Checkpoint == "" || r.conf.DryRun || line <= r.checkpoint[abs] {
+		return nil
+	}
+	if err := r.Drain(); err != nil {
+		return err
+	}
+	r.checkpoint[abs] = line
+	data, err := json.Marshal(r.checkpoint)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+	tmp := r.conf.Checkpoint + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("ioutil.WriteFile: %s", err.Error())
+	}
+	if err = os.Rename(tmp, r.conf.Checkpoint); err != nil {
+		return fmt.Errorf("os.Rename: %s", err.Error())
+	}
+	return nil
+}
+
+// Drain waits for the publisher buffers to be empty up to the drain timeout
+func (r *Replayer) Drain() error {
+	if r.p == nil {
+		return nil
+	}
+	deadline := time.Now().Add(time.Duration(r.conf.DrainTimeout) * time.Second)
+	for r.p.Buffered() > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d messages are not published in %ds",
+				r.p.Buffered(), r.conf.DrainTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+type record struct {
+	msg       amqp.AMQPMessage
+	eventName string
+	msisdn    string
+	at        time.Time
+	skip      bool // the tap record of the consumed or not published message
+}
+
+// tapped are the tap record fields missing in the dump
+type tapped struct {
+	Direction string    `json:"direction"`
+	Outcome   string    `json:"outcome"`
+	At        time.Time `json:"at"`
+}
+
+// event is the decoded body
+type event struct {
+	EventName  string                 `json:"event_name"`
+	EventData  map[string]interface{} `json:"event_data"`
+	OccurredAt time.Time              `json:"occurred_at"`
+}
+
+func (r *Replayer) parse(abs string, n int, data []byte) (rec record, err error) {
+	var keys map[string]json.RawMessage
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return rec, fmt.Errorf("json.Unmarshal: %s", err.Error())
+	}
+	has := func(key string) bool {
+		_, ok := keys[key]
+		return ok
+	}
+
+	switch {
+	case has("body") || has("body_base64"):
+		var d amqp.DumpedMessage
+		if err = json.Unmarshal(data, &d); err != nil {
+			return rec, fmt.Errorf("dump json.Unmarshal: %s", err.Error())
+		}
+		rec.msg = amqp.AMQPMessage{
+			QueueName:     d.Queue,
+			Priority:      d.Priority,
+			Body:          d.Bytes(),
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			ContentType:   d.ContentType,
+			MessageId:     d.MessageId,
+			Headers:       d.Headers,
+		}
+		if d.Timestamp != nil {
+			rec.at = *d.Timestamp
+		} else {
+			rec.at = d.DumpedAt
+		}
+		if has("direction") {
+			var t tapped
+			if err = json.Unmarshal(data, &t); err != nil {
+				return rec, fmt.Errorf("tap json.Unmarshal: %s", err.Error())
+			}
+			rec.skip = t.Direction != amqp.TapPublished || t.Outcome != amqp.TapOutcomePublished
+			if rec.at.IsZero() {
+				rec.at = t.At
+			}
+		}
+	case has("Body"):
+		if err = json.Unmarshal(data, &rec.msg); err != nil {
+			return rec, fmt.Errorf("outbox json.Unmarshal: %s", err.Error())
+		}
+		rec.msg.NotBefore = time.Time{}
+	case has("event_name"):
+		// the line is the message body
+		rec.msg = amqp.AMQPMessage{
+			Body:        append([]byte(nil), data...),
+			ContentType: amqp.ContentTypeText,
+		}
+	default:
+		return rec, fmt.Errorf("unknown line format")
+	}
+
+	codec, err := amqp.CodecFor(rec.msg.ContentType)
+	if err == nil {
+		var e event
+		if codec.Unmarshal(rec.msg.Body, &e) == nil {
+			rec.eventName = e.EventName
+			if msisdn, ok := e.EventData["msisdn"].(string); ok {
+				rec.msisdn = msisdn
+			}
+			if !e.OccurredAt.IsZero() {
+				rec.at = e.OccurredAt
+			}
+			if rec.at.IsZero() {
+				if sentAt, ok := e.EventData["sent_at"].(string); ok {
+					rec.at, _ = time.Parse(time.RFC3339Nano, sentAt)
+				}
+			}
+		}
+	}
+	if rec.eventName == "" {
+		rec.eventName = rec.msg.EventName
+	}
+	rec.msg.EventName = rec.eventName
+
+	if r.conf.Queue != "" {
+		rec.msg.QueueName = r.conf.Queue
+	}
+	if rec.msg.MessageId == "" {
+		sum := sha1.Sum([]byte(abs + ":" + strconv.Itoa(n)))
+		rec.msg.MessageId = "replay-" + hex.EncodeToString(sum[:])
+	}
+	return rec, nil
+}
+
+func (r *Replayer) match(rec record) bool {
+	if r.eventNames != nil && !r.eventNames[rec.eventName] {
+		return false
+	}
+	if r.msisdns != nil && !r.msisdns[rec.msisdn] {
+		return false
+	}
+	if !r.conf.From.IsZero() || !r.conf.To.IsZero() {
+		if rec.at.IsZero() {
+			return false
+		}
+		if !r.conf.From.IsZero() && rec.at.Before(r.conf.From) {
+			return false
+		}
+		if !r.conf.To.IsZero() && !rec.at.Before(r.conf.To) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkit360/go-utils/amqp"
+)
+
+type fakePublisher struct {
+	msgs []amqp.AMQPMessage
+}
+
+func (p *fakePublisher) PublishContext(ctx context.Context, msg amqp.AMQPMessage) error {
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *fakePublisher) Buffered() int {
+	return 0
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		err       bool
+		skip      bool
+		queue     string
+		eventName string
+		msisdn    string
+		messageId string // empty - derived from the line
+	}{
+		{
+			name:      "admin dump",
+			line:      `{"queue":"q1","message_id":"m1","delivery_mode":2,"body":"{\"event_name\":\"charge\",\"event_data\":{\"msisdn\":\"7999\"}}"}`,
+			queue:     "q1",
+			eventName: "charge",
+			msisdn:    "7999",
+			messageId: "m1",
+		},
+		{
+			name:      "published tap record",
+			line:      `{"direction":"published","outcome":"published","queue":"q1","message_id":"m2","body":"{\"event_name\":\"charge\"}"}`,
+			queue:     "q1",
+			eventName: "charge",
+			messageId: "m2",
+		},
+		{
+			name: "consumed tap record",
+			line: `{"direction":"consumed","outcome":"acked","queue":"q1","body":"{\"event_name\":\"charge\"}"}`,
+			skip: true,
+		},
+		{
+			name: "dropped tap record",
+			line: `{"direction":"published","outcome":"dropped","queue":"q1","body":"{\"event_name\":\"charge\"}"}`,
+			skip: true,
+		},
+		{
+			name:      "outbox",
+			line:      `{"QueueName":"q2","EventName":"charge","MessageId":"m3","Body":"eyJldmVudF9uYW1lIjoiY2hhcmdlIn0="}`,
+			queue:     "q2",
+			eventName: "charge",
+			messageId: "m3",
+		},
+		{
+			name:      "event notify",
+			line:      `{"event_name":"charge","event_data":{"msisdn":"7999"}}`,
+			eventName: "charge",
+			msisdn:    "7999",
+		},
+		{name: "unknown format", line: `{"foo":1}`, err: true},
+		{name: "not json", line: `charge`, err: true},
+	}
+	r, err := New(Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := r.parse("/dump.jsonl", 7, []byte(tt.line))
+			if (err != nil) != tt.err {
+				t.Fatalf("parse error %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if rec.skip != tt.skip {
+				t.Fatalf("skip %v, want %v", rec.skip, tt.skip)
+			}
+			if tt.skip {
+				return
+			}
+			if rec.msg.QueueName != tt.queue || rec.eventName != tt.eventName || rec.msisdn != tt.msisdn {
+				t.Fatalf("got %s %s %s", rec.msg.QueueName, rec.eventName, rec.msisdn)
+			}
+			if tt.messageId != "" && rec.msg.MessageId != tt.messageId {
+				t.Fatalf("message id %s, want %s", rec.msg.MessageId, tt.messageId)
+			}
+			if tt.messageId == "" && !strings.HasPrefix(rec.msg.MessageId, "replay-") {
+				t.Fatalf("message id %s is not derived", rec.msg.MessageId)
+			}
+		})
+	}
+
+	// the derived id is the same on the next replay of the line
+	a, _ := r.parse("/dump.jsonl", 7, []byte(`{"event_name":"charge"}`))
+	b, _ := r.parse("/dump.jsonl", 7, []byte(`{"event_name":"charge"}`))
+	c, _ := r.parse("/dump.jsonl", 8, []byte(`{"event_name":"charge"}`))
+	if a.msg.MessageId != b.msg.MessageId || a.msg.MessageId == c.msg.MessageId {
+		t.Fatalf("derived ids %s %s %s", a.msg.MessageId, b.msg.MessageId, c.msg.MessageId)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	at := time.Date(2017, 1, 2, 15, 0, 0, 0, time.UTC)
+	rec := record{eventName: "charge", msisdn: "7999", at: at}
+	tests := []struct {
+		name string
+		conf Config
+		rec  record
+		want bool
+	}{
+		{"no filters", Config{}, rec, true},
+		{"event name", Config{EventNames: []string{"charge"}}, rec, true},
+		{"other event name", Config{EventNames: []string{"refund"}}, rec, false},
+		{"msisdn", Config{Msisdns: []string{"7999", "7000"}}, rec, true},
+		{"other msisdn", Config{Msisdns: []string{"7000"}}, rec, false},
+		{"from", Config{From: at}, rec, true},
+		{"before from", Config{From: at.Add(time.Second)}, rec, false},
+		{"to is excluded", Config{To: at}, rec, false},
+		{"before to", Config{To: at.Add(time.Second)}, rec, true},
+		{"no time with period", Config{From: at}, record{eventName: "charge"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(tt.conf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.match(tt.rec); got != tt.want {
+				t.Fatalf("match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeLines(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCheckpoint(t *testing.T, path, dump string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var checkpoint map[string]int
+	if err = json.Unmarshal(data, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint[dump]
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "dump.jsonl")
+	conf := Config{
+		Queue:           "q",
+		Checkpoint:      filepath.Join(dir, "replay.checkpoint"),
+		CheckpointEvery: 1,
+	}
+	ok := `{"event_name":"charge"}`
+	writeLines(t, dump, ok, ok, ok)
+
+	tests := []struct {
+		name       string
+		dryRun     bool
+		lines      []string
+		published  int
+		resumed    int
+		failed     int
+		checkpoint int
+	}{
+		{"dry run keeps the checkpoint", true, nil, 3, 0, 0, 0},
+		{"replayed", false, nil, 3, 0, 0, 3},
+		{"resumed", false, nil, 0, 3, 0, 3},
+		{"new lines", false, []string{ok, ok, ok, ok, ok}, 2, 3, 0, 5},
+		{"failed line holds the checkpoint", false, []string{ok, ok, ok, ok, ok, "bad", ok}, 1, 5, 1, 5},
+		{"failed line is replayed again", false, nil, 1, 5, 1, 5},
+		{"fixed line passes", false, []string{ok, ok, ok, ok, ok, ok, ok}, 2, 5, 0, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.lines != nil {
+				writeLines(t, dump, tt.lines...)
+			}
+			c := conf
+			c.DryRun = tt.dryRun
+			p := &fakePublisher{}
+			r, err := New(c, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := r.Replay(context.Background(), dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Published != tt.published || stats.Resumed != tt.resumed || stats.Failed != tt.failed {
+				t.Fatalf("stats %+v", stats)
+			}
+			if !tt.dryRun && len(p.msgs) != tt.published {
+				t.Fatalf("published %d, stats %d", len(p.msgs), stats.Published)
+			}
+			if got := readCheckpoint(t, conf.Checkpoint, dump); got != tt.checkpoint {
+				t.Fatalf("checkpoint %d, want %d", got, tt.checkpoint)
+			}
+		})
+	}
+}
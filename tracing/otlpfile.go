@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// fileClient writes every export as the otlp json line,
+// otlp json keeps the trace and span ids in hex, not in base64 as protojson does
+type fileClient struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *fileClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *fileClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (c *fileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	data, err := protojson.Marshal(&collectorpb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return fmt.Errorf("protojson.Marshal: %s", err.Error())
+	}
+	var v interface{}
+	if err = json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %s", err.Error())
+	}
+	hexIds(v)
+	if data, err = json.Marshal(v); err != nil {
+		return fmt.Errorf("json.Marshal: %s", err.Error())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err = c.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write: %s", err.Error())
+	}
+	return nil
+}
+
+func hexIds(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch key {
+			case "traceId", "spanId", "parentSpanId":
+				if s, ok := value.(string); ok {
+					if id, err := base64.StdEncoding.DecodeString(s); err == nil {
+						v[key] = hex.EncodeToString(id)
+					}
+				}
+			default:
+				hexIds(value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			hexIds(value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package tracing
+
+// opentelemetry tracing of the services: the http click, the amqp hops and the db queries
+// share one trace, the trace context goes in the http and amqp headers (w3c traceparent).
+// the spans are exported to stdout or to the file, so the tracing works offline,
+// the otlp file is read by the collector otlpjsonfile receiver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterStdout   = "stdout"    // span json to stdout
+	ExporterFile     = "file"      // span json lines to the path
+	ExporterOTLPFile = "otlp_file" // otlp json lines to the path
+)
+
+type Config struct {
+	Enabled     bool    `yaml:"enabled" default:"false"`
+	ServiceName string  `yaml:"service_name" default:""`   // the binary name by default
+	Exporter    string  `yaml:"exporter" default:"stdout"` // stdout, file or otlp_file
+	Path        string  `yaml:"path" default:""`           // file of the file exporters
+	SampleRatio float64 `yaml:"sample_ratio" default:"1"`  // of the new traces, the remote parent decides for the rest
+}
+
+// Propagator reads and writes the trace context and baggage,
+// the amqp package uses the same format
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+var (
+	mu       sync.Mutex
+	provider *sdktrace.TracerProvider
+	output   io.Closer
+)
+
+// Init sets the global tracer provider and propagator,
+// disabled tracing keeps the noop provider but still propagates the incoming trace context
+func Init(conf Config) error {
+	otel.SetTextMapPropagator(Propagator)
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.ServiceName == "" {
+		conf.ServiceName = filepath.Base(os.Args[0])
+	}
+
+	exporter, closer, err := newExporter(conf)
+	if err != nil {
+		return err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", conf.ServiceName),
+	))
+	if err != nil {
+		return fmt.Errorf("resource.Merge: %s", err.Error())
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	mu.Lock()
+	provider, output = tp, closer
+	mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"service":  conf.ServiceName,
+		"exporter": conf.Exporter,
+		"path":     conf.Path,
+	}).Info("tracing init done")
+	return nil
+}
+
+func newExporter(conf Config) (sdktrace.SpanExporter, io.Closer, error) {
+	switch conf.Exporter {
+	case "", ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, nil, fmt.Errorf("stdouttrace.New: %s", err.Error())
+		}
+		return exporter, nil, nil
+
+	case ExporterFile, ExporterOTLPFile:
+		if conf.Path == "" {
+			return nil, nil, fmt.Errorf("tracing exporter %s: empty path", conf.Exporter)
+		}
+		f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("os.OpenFile: %s", err.Error())
+		}
+		var exporter sdktrace.SpanExporter
+		if conf.Exporter == ExporterFile {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		} else {
+			exporter, err = otlptrace.New(context.Background(), &fileClient{w: f})
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%s exporter: %s", conf.Exporter, err.Error())
+		}
+		return exporter, f, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown tracing exporter: %s", conf.Exporter)
+	}
+}
+
+// Shutdown exports the buffered spans and closes the file
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	tp, closer := provider, output
+	provider, output = nil, nil
+	mu.Unlock()
+
+	if tp == nil {
+		return nil
+	}
+	if err := tp.Shutdown(ctx); err != nil {
+		return fmt.Errorf("TracerProvider.Shutdown: %s", err.Error())
+	}
+	if closer != nil {
+		if err := closer.Close(); err != nil {
+			return fmt.Errorf("file.Close: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// TraceId of the span in ctx for envelope.Envelope and the logs, empty if there is no trace
+func TraceId(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Fields are the log fields of the span in ctx, so the logs are found by the trace
+func Fields(ctx context.Context) log.Fields {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log.Fields{}
+	}
+	return log.Fields{
+		"trace_id": sc.TraceID().String(),
+		"span_id":  sc.SpanID().String(),
+	}
+}